@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When the server started, for the uptime reported by the admin interface.
+var started = time.Now()
+
+// Whether the server has been marked down through the admin interface, so
+// that a load balancer checking its health stops sending it traffic.
+var down atomic.Bool
+
+// The value of every gauge as of the last flush. Backends keep their own
+// copies, these are kept to be listed through the admin interface.
+var flushedGauges = &gaugeValues{values: make(map[string]float64)}
+
+type gaugeValues struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (g *gaugeValues) apply(s *snapshot) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	applyGauges(g.values, s)
+}
+
+// Returns the current value of every gauge, including the updates received
+// since the last flush.
+func (g *gaugeValues) current(s *snapshot) map[string]float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := maps.Clone(g.values)
+	applyGauges(values, s)
+
+	return values
+}
+
+func (g *gaugeValues) delete(match func(string) bool) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return deleteKeys(g.values, match)
+}
+
+// The commands of the admin interface, which match the management console of
+// Etsy's statsd.
+var adminCommands = map[string]func(w io.Writer, args []string){
+	"stats":       adminStats,
+	"config":      adminConfig,
+	"counters":    func(w io.Writer, args []string) { writeAdminJson(w, aggregator.Peek().counters) },
+	"timers":      func(w io.Writer, args []string) { writeAdminJson(w, aggregator.Peek().timers) },
+	"gauges":      func(w io.Writer, args []string) { writeAdminJson(w, flushedGauges.current(aggregator.Peek())) },
+	"delcounters": func(w io.Writer, args []string) { adminDelete(w, "c", args) },
+	"deltimers":   func(w io.Writer, args []string) { adminDelete(w, "ms", args) },
+	"delgauges":   func(w io.Writer, args []string) { adminDelete(w, "g", args) },
+	"health":      adminHealth,
+}
+
+// Handles admin commands, one per line, until the client quits or the
+// connection is closed.
+func handleAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	r := newLineReader(conn, *tcpMaxLine)
+	w := bufio.NewWriter(conn)
+
+	for {
+		if *tcpTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(*tcpTimeout) * time.Second))
+		}
+
+		line, err := readLine(r, *tcpMaxLine)
+		if fields := strings.Fields(string(line)); len(fields) > 0 {
+			if fields[0] == "quit" {
+				return
+			}
+
+			if *debug {
+				log.Printf("admin command from %s: %s\n", conn.RemoteAddr(), string(line))
+			}
+
+			if cmd, found := adminCommands[fields[0]]; found {
+				cmd(w, fields[1:])
+			} else if fields[0] == "help" {
+				adminHelp(w)
+			} else {
+				io.WriteString(w, "ERROR\n")
+			}
+
+			if e := w.Flush(); e != nil {
+				return
+			}
+		}
+
+		switch err {
+		case nil, errLineTooLong:
+		case io.EOF:
+			return
+		default:
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("closing admin connection from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+func adminHelp(w io.Writer) {
+	names := slices.Sorted(maps.Keys(adminCommands))
+	fmt.Fprintf(w, "Commands: %s, help, quit\n\n", strings.Join(names, ", "))
+}
+
+// Writes the uptime, the seconds since the last packet was received, and when
+// each backend last flushed successfully and last failed, as unix times.
+func adminStats(w io.Writer, args []string) {
+	now := time.Now()
+
+	fmt.Fprintf(w, "uptime: %d\n", int64(now.Sub(started).Seconds()))
+
+	last := aggregator.LastAdded()
+	if last.IsZero() {
+		last = started
+	}
+	fmt.Fprintf(w, "messages.last_msg_seen: %d\n", int64(now.Sub(last).Seconds()))
+
+	for _, b := range backends {
+		if s, ok := b.(reporter); ok {
+			r := s.report()
+			fmt.Fprintf(w, "%s.last_flush: %d\n", b.Name(), unixTime(r.success))
+			fmt.Fprintf(w, "%s.last_exception: %d\n", b.Name(), unixTime(r.failure))
+		}
+	}
+
+	io.WriteString(w, "END\n\n")
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// The settings listed by the config command, copied when the configuration
+// is loaded and reloaded so that listing them doesn't wait on a flush.
+var adminSettings atomic.Pointer[string]
+
+// Copies every setting, without the values of secrets, and the metric rules.
+// The caller must hold flushMu for writing once backends are flushing.
+func storeAdminSettings() {
+	var b strings.Builder
+
+	for _, key := range slices.Sorted(maps.Keys(configKeys)) {
+		name := configKeys[key]
+		v := flag.Lookup(name).Value.String()
+		if secrets[name] && v != "" {
+			v = "(hidden)"
+		}
+		fmt.Fprintf(&b, "%s: %q\n", key, v)
+	}
+
+	for _, r := range getRules() {
+		fmt.Fprintf(&b, "metrics: %s\n", r)
+	}
+
+	s := b.String()
+	adminSettings.Store(&s)
+}
+
+// Writes the settings as of the last load or reload.
+func adminConfig(w io.Writer, args []string) {
+	if s := adminSettings.Load(); s != nil {
+		io.WriteString(w, *s)
+	}
+
+	io.WriteString(w, "END\n\n")
+}
+
+func writeAdminJson(w io.Writer, v interface{}) {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(b)
+	io.WriteString(w, "\nEND\n\n")
+}
+
+// Deletes metrics of a bucket from the current interval and from every
+// backend that keeps them between flushes. Each argument is a key, or a
+// prefix ending in ".*" that deletes every key in that folder.
+// "api.*" => "api.hits", "api.errors.500"
+func adminDelete(w io.Writer, bucket string, args []string) {
+	// Backends only modify the metrics they keep while flushing.
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	for _, arg := range args {
+		match := func(k string) bool { return k == arg }
+		if folder, found := strings.CutSuffix(arg, "*"); found && strings.HasSuffix(folder, ".") {
+			match = func(k string) bool { return k == arg || strings.HasPrefix(k, folder) }
+		}
+
+		deleted := make(map[string]bool)
+		for _, k := range aggregator.Delete(bucket, match) {
+			deleted[k] = true
+		}
+
+		if bucket == "g" {
+			for _, k := range flushedGauges.delete(match) {
+				deleted[k] = true
+			}
+		}
+
+		for _, b := range backends {
+			if d, ok := b.(deleter); ok {
+				for _, k := range d.delete(bucket, match) {
+					deleted[k] = true
+				}
+			}
+		}
+
+		if len(deleted) == 0 {
+			fmt.Fprintf(w, "metric %s not found\n", arg)
+		}
+
+		for _, k := range slices.Sorted(maps.Keys(deleted)) {
+			fmt.Fprintf(w, "deleted: %s\n", k)
+		}
+	}
+
+	io.WriteString(w, "END\n\n")
+}
+
+// Reports whether the server is up, or marks it up or down.
+func adminHealth(w io.Writer, args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "up":
+			down.Store(false)
+		case "down":
+			down.Store(true)
+		default:
+			io.WriteString(w, "ERROR\n")
+			return
+		}
+		log.Printf("health set to %s through the admin interface\n", args[0])
+	}
+
+	if down.Load() {
+		io.WriteString(w, "health: down\n")
+	} else {
+		io.WriteString(w, "health: up\n")
+	}
+}
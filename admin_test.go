@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminDelete(t *testing.T) {
+	aggregator.Snapshot()
+
+	saved := backends
+	defer func() { backends = saved }()
+
+	b := &libratoBackend{
+		counters: map[string]float64{"api.old": 10, "web.old": 1},
+		gauges:   map[string]float64{"api.depth": 2},
+	}
+	backends = []Backend{b}
+
+	for _, name := range []string{"api.hits", "api.errors.500", "apis", "web.hits"} {
+		aggregator.Add(packet{name: name, bucket: "c", value: 1})
+	}
+
+	var w bytes.Buffer
+	adminDelete(&w, "c", []string{"api.*", "web.hits", "missing"})
+
+	expect := "deleted: api.errors.500\ndeleted: api.hits\ndeleted: api.old\ndeleted: web.hits\nmetric missing not found\nEND\n\n"
+	if w.String() != expect {
+		t.Errorf("got %q, expected %q", w.String(), expect)
+	}
+
+	if s := aggregator.Snapshot(); !reflect.DeepEqual(s.counters, map[string]float64{"apis": 1}) {
+		t.Errorf("got %+v, expected only counter apis to be left", s.counters)
+	}
+
+	if !reflect.DeepEqual(b.counters, map[string]float64{"web.old": 1}) || len(b.gauges) != 1 {
+		t.Errorf("got %+v and %+v, expected only api.old to be deleted", b.counters, b.gauges)
+	}
+}
+
+func TestAdminGauges(t *testing.T) {
+	aggregator.Snapshot()
+	internal.Snapshot()
+
+	// Other flushes leave gauges behind, such as the internal ones.
+	flushedGauges.delete(func(string) bool { return true })
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = nil
+
+	flush(&snapshot{gauges: map[string]float64{"a": 1, "b": 2}})
+	aggregator.Add(packet{name: "a", bucket: "g", value: 2, relative: true})
+
+	var w bytes.Buffer
+	adminCommands["gauges"](&w, nil)
+
+	if expect := "{\n  \"a\": 3,\n  \"b\": 2\n}\nEND\n\n"; w.String() != expect {
+		t.Errorf("got %q, expected %q", w.String(), expect)
+	}
+
+	w.Reset()
+	adminDelete(&w, "g", []string{"a", "b"})
+
+	if expect := "deleted: a\ndeleted: b\nEND\n\n"; w.String() != expect {
+		t.Errorf("got %q, expected %q", w.String(), expect)
+	}
+
+	if s := aggregator.Snapshot(); len(s.gauges) != 0 || len(s.deltas) != 0 {
+		t.Errorf("got %+v, expected the gauges to be deleted", s)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+
+	b := &testBackend{name: "b", err: errors.New("failed")}
+	backends = []Backend{b}
+	b.Flush(&snapshot{})
+
+	var w bytes.Buffer
+	adminStats(&w, nil)
+
+	lines := strings.Split(w.String(), "\n")
+	if len(lines) != 7 || !strings.HasPrefix(lines[0], "uptime: ") || !strings.HasPrefix(lines[1], "messages.last_msg_seen: ") ||
+		lines[2] != "b.last_flush: 0" || lines[3] == "b.last_exception: 0" || lines[4] != "END" {
+		t.Errorf("got %q", w.String())
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	token := *libratoToken
+	defer func() { *libratoToken = token; storeAdminSettings() }()
+
+	*libratoToken = "secret"
+	storeAdminSettings()
+	*libratoToken = "changed"
+
+	// Listing the settings doesn't wait on a flush or a reload.
+	flushMu.Lock()
+	w := &bytes.Buffer{}
+	adminConfig(w, nil)
+	flushMu.Unlock()
+
+	if !strings.Contains(w.String(), "librato.token: \"(hidden)\"\n") || !strings.HasSuffix(w.String(), "END\n\n") {
+		t.Errorf("got %q", w.String())
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	aggregator.Snapshot()
+	defer down.Store(false)
+
+	in, err := openListener(listenSpec{"admin", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.start()
+	defer in.Close()
+
+	aggregator.Add(packet{name: "a", bucket: "c", value: 2})
+	aggregator.Add(packet{name: "t", bucket: "ms", value: 5})
+
+	conn, err := net.Dial("tcp", in.spec.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("counters\ntimers\nhealth\nhealth down\nhealth\nhealth sideways\nbogus\nquit\ncounters\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "{\n  \"a\": 2\n}\nEND\n\n" +
+		"{\n  \"t\": [\n    5\n  ]\n}\nEND\n\n" +
+		"health: up\nhealth: down\nhealth: down\nERROR\nERROR\n"
+	if string(out) != expect {
+		t.Errorf("got %q, expected %q", out, expect)
+	}
+
+	if !down.Load() {
+		t.Errorf("expected health to be down")
+	}
+}
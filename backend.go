@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A destination for aggregated metrics. Every backend is given the same
+// snapshot at each flush and must not modify it.
+type Backend interface {
+	Name() string
+	Flush(s *snapshot) error
+	Health() error
+}
+
+// Implemented by backends that hold on to settings when they're built, to
+// pick up changes when the configuration is reloaded without losing state.
+type reloader interface {
+	reload() error
+}
+
+// Implemented by backends that keep metrics between flushes, such as the
+// current value of gauges, so that stale keys can be deleted through the
+// admin interface. Returns the keys of the bucket that were deleted.
+type deleter interface {
+	delete(bucket string, match func(string) bool) []string
+}
+
+// Implemented by backends that embed status, to report on their flushes.
+type reporter interface {
+	report() flushReport
+}
+
+// The backends that metrics are flushed to.
+var backends []Backend
+
+// Held for reading while flushing, and for writing to change the settings or
+// the metrics that backends keep between flushes. A writer waiting on a slow
+// flush holds up every new reader, so anything else that reads the settings,
+// such as retries, copies them rather than holding it for long.
+var flushMu sync.RWMutex
+
+// The longest a single request to a backend may take, so that an endpoint
+// that hangs can't hold up flushes, and everything waiting on flushMu, for
+// longer than a flush interval.
+func backendTimeout() time.Duration {
+	return time.Duration(max(*interval, 1)) * time.Second
+}
+
+// Builds the backends named in a comma separated list.
+func newBackends(names string) (bs []Backend, err error) {
+	for _, name := range strings.Split(names, ",") {
+		var b Backend
+
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "librato":
+			b, err = newLibratoBackend()
+		case "proxy":
+			b, err = newProxyBackend(*proxy)
+		case "graphite":
+			b, err = newGraphiteBackend(*graphite)
+		case "prometheus":
+			b, err = newPrometheusBackend(*prometheus)
+		case "influxdb":
+			b, err = newInfluxBackend(*influxdb)
+		default:
+			err = fmt.Errorf("unknown backend %q", name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		bs = append(bs, b)
+	}
+
+	if len(bs) == 0 {
+		err = fmt.Errorf("no backends specified")
+	}
+
+	return
+}
+
+// Sends a snapshot to every backend. A backend that fails doesn't prevent
+// the others from receiving the snapshot.
+func flush(s *snapshot) {
+	flushMu.RLock()
+	defer flushMu.RUnlock()
+
+	flushedGauges.apply(s)
+
+	for _, b := range backends {
+		start := time.Now()
+		err := b.Flush(s)
+		timeInternal(b.Name()+".flush_time", time.Since(start))
+
+		if err != nil {
+			log.Printf("unable to flush to %s: %s\n", b.Name(), err)
+			countInternal(b.Name()+".flush_errors", 1)
+		}
+	}
+}
+
+// Flushes snapshots in the background, one at a time, so that the next
+// snapshot is taken on schedule however long a flush takes. Snapshots taken
+// while a flush is running are merged and flushed as soon as it finishes.
+type flushQueue struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running bool
+	started time.Time
+	pending *snapshot
+	held    int
+}
+
+// The most intervals held back behind a slow flush. Timers keep every value
+// they receive, so the held metrics would otherwise grow without bound.
+const flushMaxHeld = 10
+
+var flushes = &flushQueue{}
+
+func (q *flushQueue) push(s *snapshot) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running {
+		countInternal("flush_delayed", 1)
+
+		if q.held >= flushMaxHeld {
+			log.Printf("previous flush still running after %d intervals, dropping %d held metrics\n", q.held, q.pending.Count())
+			countInternal("flush_dropped", float64(q.pending.Count()))
+			q.pending, q.held = nil, 0
+		}
+
+		if q.pending != nil {
+			s = mergeSnapshots(q.pending, s)
+		}
+		q.pending = s
+		q.held++
+		log.Printf("previous flush still running, holding %d metrics until it finishes\n", s.Count())
+		return
+	}
+
+	q.running, q.started = true, time.Now()
+	q.wg.Add(1)
+	go q.run(s)
+}
+
+func (q *flushQueue) run(s *snapshot) {
+	defer q.wg.Done()
+
+	for s != nil {
+		flush(s)
+
+		q.mu.Lock()
+		s, q.pending, q.held = q.pending, nil, 0
+		q.running, q.started = s != nil, time.Now()
+		q.mu.Unlock()
+	}
+}
+
+// Reports when the running flush started, which is zero if none is running,
+// and the number of intervals and metrics held until it finishes.
+func (q *flushQueue) state() (started time.Time, intervals int, held int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending != nil {
+		intervals, held = q.held, q.pending.Count()
+	}
+
+	if q.running {
+		started = q.started
+	}
+
+	return
+}
+
+// Waits for the running flush, and any held snapshot, to finish.
+func (q *flushQueue) wait() {
+	q.wg.Wait()
+}
+
+// Tracks the outcome of a backend's most recent flush.
+type status struct {
+	mu sync.Mutex
+	flushReport
+}
+
+// When a backend's flushes happened and how the most recent one went.
+// Failing is when the current run of failed flushes started, and is zero if
+// the most recent flush succeeded.
+type flushReport struct {
+	last    time.Time
+	success time.Time
+	failure time.Time
+	failing time.Time
+	err     error
+}
+
+func (s *status) record(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last = time.Now()
+	s.err = err
+	if err == nil {
+		s.success = s.last
+		s.failing = time.Time{}
+	} else {
+		s.failure = s.last
+		if s.failing.IsZero() {
+			s.failing = s.last
+		}
+	}
+
+	return err
+}
+
+// Returns the error from the most recent flush, if it failed.
+func (s *status) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *status) report() flushReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushReport
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewBackends(t *testing.T) {
+	address := *proxy
+	defer func() { *proxy = address }()
+	*proxy = "127.0.0.1:8126"
+
+	bs, err := newBackends("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bs) != 1 || bs[0].Name() != "proxy" {
+		t.Errorf("got %+v, expected the proxy backend", bs)
+	}
+
+	for _, names := range []string{"", " , ", "unknown", "proxy,unknown"} {
+		if _, err := newBackends(names); err == nil {
+			t.Errorf("%q: expected an error", names)
+		}
+	}
+
+	*proxy = ""
+	if _, err := newBackends("proxy"); err == nil {
+		t.Errorf("expected an error without a proxy address")
+	}
+}
+
+type testBackend struct {
+	status
+	name      string
+	err       error
+	flushes   int
+	snapshots []*snapshot
+	block     chan struct{}
+}
+
+func (b *testBackend) Name() string {
+	return b.name
+}
+
+func (b *testBackend) Flush(s *snapshot) error {
+	if b.block != nil {
+		<-b.block
+	}
+
+	b.flushes++
+	b.snapshots = append(b.snapshots, s)
+	return b.record(b.err)
+}
+
+func TestFlush(t *testing.T) {
+	a := &testBackend{name: "a", err: errors.New("failed")}
+	b := &testBackend{name: "b"}
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = []Backend{a, b}
+
+	flush(&snapshot{})
+
+	if a.flushes != 1 || b.flushes != 1 {
+		t.Errorf("got %d and %d flushes, expected 1 each", a.flushes, b.flushes)
+	}
+
+	if a.Health() == nil || b.Health() != nil {
+		t.Errorf("got health %v and %v, expected only a to fail", a.Health(), b.Health())
+	}
+}
+
+func TestFlushQueue(t *testing.T) {
+	b := &testBackend{name: "b", block: make(chan struct{})}
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = []Backend{b}
+
+	q := &flushQueue{}
+
+	// The first flush blocks, so the next two snapshots are held and merged.
+	q.push(&snapshot{counters: map[string]float64{"a": 1}})
+	q.push(&snapshot{counters: map[string]float64{"a": 2}})
+	q.push(&snapshot{counters: map[string]float64{"a": 3}})
+
+	b.block <- struct{}{}
+	b.block <- struct{}{}
+	q.wait()
+
+	if b.flushes != 2 {
+		t.Fatalf("got %d flushes, expected 2", b.flushes)
+	}
+
+	if b.snapshots[0].counters["a"] != 1 || b.snapshots[1].counters["a"] != 5 {
+		t.Errorf("got %+v and %+v, expected a of 1 then 5", b.snapshots[0].counters, b.snapshots[1].counters)
+	}
+
+	// Once idle, the next snapshot is flushed straight away.
+	close(b.block)
+	q.push(&snapshot{counters: map[string]float64{"a": 4}})
+	q.wait()
+
+	if b.flushes != 3 {
+		t.Errorf("got %d flushes, expected 3", b.flushes)
+	}
+}
+
+func TestFlushQueueDropped(t *testing.T) {
+	b := &testBackend{name: "b", block: make(chan struct{})}
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = []Backend{b}
+
+	internal.Snapshot()
+
+	// Once flushMaxHeld intervals are held, they're dropped to make room.
+	q := &flushQueue{}
+	for i := 0; i <= flushMaxHeld+1; i++ {
+		q.push(&snapshot{counters: map[string]float64{"a": 1}})
+	}
+
+	if s := internal.Snapshot(); s.counters["statsd.flush_dropped"] != 1 {
+		t.Errorf("got %+v, expected the held metrics to be counted as dropped", s.counters)
+	}
+
+	close(b.block)
+	q.wait()
+
+	if b.flushes != 2 || b.snapshots[1].counters["a"] != 1 {
+		t.Errorf("got %d flushes, the last with %+v, expected a of 1", b.flushes, b.snapshots[len(b.snapshots)-1].counters)
+	}
+}
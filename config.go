@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The settings that can be given in a config file, and the flag each one
+// sets. Settings in a [section] are named "section.key".
+var configKeys = map[string]string{
+	"listen":           "listen",
+	"address":          "address",
+	"backends":         "backends",
+	"flush":            "flush",
+	"percentiles":      "percentiles",
+	"shutdown_timeout": "shutdown-timeout",
+	"stats_prefix":     "stats-prefix",
+	"debug":            "debug",
+
+	"udp.max_size": "udp-max-size",
+	"udp.rcvbuf":   "udp-rcvbuf",
+	"udp.readers":  "udp-readers",
+
+	"tcp.max_line":  "tcp-max-line",
+	"tcp.timeout":   "tcp-timeout",
+	"tcp.max_conns": "tcp-max-conns",
+
+	"unix.stream":   "unix",
+	"unix.datagram": "unixgram",
+	"unix.mode":     "unix-mode",
+	"unix.owner":    "unix-owner",
+
+	"http.max_size":          "http-max-size",
+	"http.token":             "http-token",
+	"http.ready_max_failing": "ready-max-failing",
+
+	"health.address": "health",
+
+	"librato.user":        "user",
+	"librato.token":       "token",
+	"librato.source":      "source",
+	"librato.api":         "api",
+	"librato.tags":        "tags",
+	"librato.batch":       "batch",
+	"librato.concurrency": "concurrency",
+
+	"retry.size": "retry-size",
+	"retry.age":  "retry-age",
+
+	"spool.dir":  "spool",
+	"spool.size": "spool-size",
+
+	"proxy.address": "proxy",
+
+	"graphite.address":        "graphite",
+	"graphite.prefix":         "graphite-prefix",
+	"graphite.counter_prefix": "graphite-counter-prefix",
+	"graphite.timer_prefix":   "graphite-timer-prefix",
+	"graphite.gauge_prefix":   "graphite-gauge-prefix",
+	"graphite.set_prefix":     "graphite-set-prefix",
+
+	"prometheus.address": "prometheus",
+
+	"influxdb.url":       "influxdb",
+	"influxdb.database":  "influxdb-database",
+	"influxdb.bucket":    "influxdb-bucket",
+	"influxdb.org":       "influxdb-org",
+	"influxdb.token":     "influxdb-token",
+	"influxdb.precision": "influxdb-precision",
+	"influxdb.batch":     "influxdb-batch",
+}
+
+// Flags that take a comma separated list, which may be given as an array in
+// a config file.
+var listFlags = map[string]bool{
+	"listen":      true,
+	"backends":    true,
+	"percentiles": true,
+	"tags":        true,
+}
+
+// The environment variable that each flag falls back to.
+var flagEnv = map[string]string{
+	"listen":         "LISTEN",
+	"backends":       "BACKENDS",
+	"percentiles":    "PERCENTILES",
+	"http-token":     "HTTP_TOKEN",
+	"user":           "LIBRATO_USER",
+	"token":          "LIBRATO_TOKEN",
+	"source":         "LIBRATO_SOURCE",
+	"api":            "LIBRATO_API",
+	"tags":           "LIBRATO_TAGS",
+	"spool":          "SPOOL",
+	"proxy":          "PROXY",
+	"graphite":       "GRAPHITE",
+	"prometheus":     "PROMETHEUS",
+	"influxdb":       "INFLUXDB",
+	"influxdb-token": "INFLUXDB_TOKEN",
+}
+
+// A single setting read from a config file.
+type setting struct {
+	key   string
+	flag  string
+	value string
+	line  int
+}
+
+// Sets every flag that wasn't given on the command line.
+func loadConfig() error {
+	values, rules, err := resolveConfig()
+	if err != nil {
+		return err
+	}
+
+	for name, v := range values {
+		if err := flag.Lookup(name).Value.Set(v); err != nil {
+			return fmt.Errorf("invalid -%s %q: %s", name, v, err)
+		}
+	}
+
+	setRules(rules)
+
+	return nil
+}
+
+// Works out the value of every flag from, in order of precedence, the
+// command line, its environment variable, the config file and finally the
+// defaults, some of which depend on other settings, along with the metric
+// rules of the config file. The flags themselves are left alone.
+func resolveConfig() (values map[string]string, rules []metricRule, err error) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	values = make(map[string]string)
+	for _, name := range append(slices.Collect(maps.Values(configKeys)), "config") {
+		f := flag.Lookup(name)
+		if set[name] {
+			values[name] = f.Value.String()
+		} else {
+			values[name] = f.DefValue
+		}
+	}
+
+	if v := os.Getenv("CONFIG"); v != "" && !set["config"] {
+		values["config"] = v
+	}
+
+	if path := values["config"]; path != "" {
+		var settings []setting
+		if settings, rules, err = readConfig(path); err != nil {
+			return nil, nil, err
+		}
+
+		for _, s := range settings {
+			if !set[s.flag] {
+				values[s.flag] = s.value
+			}
+		}
+	}
+
+	for name, env := range flagEnv {
+		if v := os.Getenv(env); v != "" && !set[name] {
+			values[name] = v
+		}
+	}
+
+	if values["api"] == "" {
+		values["api"] = "metrics"
+	}
+
+	if values["backends"] == "" {
+		if values["proxy"] != "" {
+			values["backends"] = "proxy"
+		} else {
+			values["backends"] = "librato"
+		}
+	}
+
+	if values["listen"] == "" {
+		values["listen"] = defaultListenSpecs(values["address"], values["health"], values["unixgram"], values["unix"])
+	}
+
+	return
+}
+
+func readConfig(path string) ([]setting, []metricRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return parseConfig(f, path)
+}
+
+var (
+	reConfigSection = regexp.MustCompile(`^\[\s*([a-z_]+)\s*\]$`)
+	reConfigTable   = regexp.MustCompile(`^\[\[\s*([a-z_]+)\s*\]\]$`)
+	reConfigKey     = regexp.MustCompile(`^([a-z_]+(?:\s*\.\s*[a-z_]+)*)\s*=\s*(.*)$`)
+	reStatsPrefix   = regexp.MustCompile(`^([a-zA-Z0-9_]+(\.[a-zA-Z0-9_]+)*)?$`)
+)
+
+// Parses a config file in the subset of toml described in the readme: bare
+// and dotted keys, [sections], [[metrics]] tables, and values that are basic
+// or literal strings on a single line, integers and floats, booleans, and
+// arrays of them that may span several lines, with # comments. Every problem
+// is reported, each with its line number.
+func parseConfig(r io.Reader, name string) (settings []setting, rules []metricRule, err error) {
+	var errs []error
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...)))
+	}
+
+	seen := make(map[string]int)
+	section := ""
+
+	// The [[metrics]] table being read, if any, and the line it started on.
+	var rule *metricRule
+	ruleLine := 0
+	endRule := func() {
+		if rule == nil {
+			return
+		}
+		if rule.match == "" {
+			fail(ruleLine, "[[metrics]] requires a match")
+		} else {
+			rules = append(rules, *rule)
+		}
+		rule = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if m := reConfigTable.FindStringSubmatch(line); m != nil {
+			endRule()
+			section = m[1]
+			if m[1] != "metrics" {
+				fail(n, "unknown table [[%s]], expected [[metrics]]", m[1])
+				continue
+			}
+			rule, ruleLine = &metricRule{}, n
+			continue
+		}
+
+		if m := reConfigSection.FindStringSubmatch(line); m != nil {
+			endRule()
+			section = m[1]
+			continue
+		}
+
+		m := reConfigKey.FindStringSubmatch(line)
+		if m == nil {
+			fail(n, "expected \"key = value\", \"[section]\" or \"[[metrics]]\", got %q", line)
+			continue
+		}
+
+		key, raw, start := strings.Join(strings.Fields(strings.ReplaceAll(m[1], ".", " ")), "."), m[2], n
+		if section != "" {
+			key = section + "." + key
+		}
+
+		// Arrays may continue over several lines until they are closed.
+		for strings.HasPrefix(raw, "[") && !arrayClosed(raw) && scanner.Scan() {
+			n++
+			raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+
+		seenKey := key
+		if rule != nil {
+			seenKey = fmt.Sprintf("%s@%d", key, ruleLine)
+		}
+		if prev, dup := seen[seenKey]; dup {
+			fail(start, "%s is already set on line %d", key, prev)
+			continue
+		}
+		seen[seenKey] = start
+
+		if rule != nil {
+			if e := parseRuleSetting(rule, key, raw); e != nil {
+				fail(start, "%s", e)
+			}
+			continue
+		}
+
+		name, found := configKeys[key]
+		if !found {
+			fail(start, "unknown setting %q", key)
+			continue
+		}
+
+		value, e := parseConfigValue(raw, name)
+		if e != nil {
+			fail(start, "invalid %s: %s", key, e)
+			continue
+		}
+
+		settings = append(settings, setting{key: key, flag: name, value: value, line: start})
+	}
+
+	endRule()
+
+	if e := scanner.Err(); e != nil {
+		errs = append(errs, e)
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	return
+}
+
+// Sets a key of a [[metrics]] table.
+func parseRuleSetting(rule *metricRule, key string, raw string) error {
+	switch key {
+	case "metrics.match":
+		v, kind, err := parseConfigScalar(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", key, err)
+		}
+		if kind != "string" || !validPattern(v) {
+			return fmt.Errorf("invalid %s: expected a metric name, a folder ending in \".*\" or \"*\", got %s", key, raw)
+		}
+		rule.match = v
+
+	case "metrics.percentiles":
+		v, err := parseConfigValue(raw, "percentiles")
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", key, err)
+		}
+		if errs := checkPercentiles(v); len(errs) > 0 {
+			return fmt.Errorf("invalid %s: %s", key, errs[0])
+		}
+		rule.percentiles, rule.tiles = v, buildTiles(v)
+
+	case "metrics.drop":
+		v, err := parseConfigValue(raw, "debug")
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", key, err)
+		}
+		rule.drop = v == "true"
+
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	return nil
+}
+
+// Converts a value to the string its flag expects, checking that it has the
+// right type. Arrays are joined with commas for flags that take a list.
+func parseConfigValue(raw string, name string) (string, error) {
+	kind := "string"
+	switch flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+	case bool:
+		kind = "boolean"
+	case int, int64:
+		kind = "number"
+	}
+
+	if strings.HasPrefix(raw, "[") {
+		if !listFlags[name] {
+			return "", fmt.Errorf("expected a %s, got an array", kind)
+		}
+
+		items, err := splitArray(raw)
+		if err != nil {
+			return "", err
+		}
+
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			v, _, err := parseConfigScalar(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, v)
+		}
+
+		return strings.Join(values, ","), nil
+	}
+
+	v, k, err := parseConfigScalar(raw)
+	if err != nil {
+		return "", err
+	}
+
+	// Numeric lists such as percentiles may be given as a single number.
+	if k != kind && !(listFlags[name] && k == "number") {
+		return "", fmt.Errorf("expected a %s, got %s", kind, raw)
+	}
+
+	if kind == "number" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return "", fmt.Errorf("expected a whole number, got %s", raw)
+		}
+	}
+
+	return v, nil
+}
+
+// Parses a quoted string, number or boolean, returning its value and kind.
+func parseConfigScalar(raw string) (value string, kind string, err error) {
+	switch {
+	case raw == "":
+		return "", "", fmt.Errorf("missing value")
+	case raw == "true" || raw == "false":
+		return raw, "boolean", nil
+	case strings.HasPrefix(raw, `"`):
+		value, err = strconv.Unquote(raw)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, "string", nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], "string", nil
+	}
+
+	// Underscores may separate the digits of a number.
+	number := raw
+	if reConfigUnderscore.MatchString(raw) {
+		number = strings.ReplaceAll(raw, "_", "")
+	}
+
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		return "", "", fmt.Errorf("expected a quoted string, number or boolean, got %s", raw)
+	}
+
+	return number, "number", nil
+}
+
+// A number whose underscores are each between two digits.
+var reConfigUnderscore = regexp.MustCompile(`^[+-]?[0-9]+(_[0-9]+)*(\.[0-9]+(_[0-9]+)*)?([eE][+-]?[0-9]+(_[0-9]+)*)?$`)
+
+// Splits an array into its items, without splitting quoted strings.
+// `["a", "b,c"]` => [`"a"`, `"b,c"`]
+func splitArray(raw string) (items []string, err error) {
+	if !strings.HasSuffix(raw, "]") || !arrayClosed(raw) {
+		return nil, fmt.Errorf("unterminated array %s", raw)
+	}
+
+	inner := strings.TrimSpace(raw[1 : len(raw)-1])
+	var quote rune
+	start := 0
+
+	for i, c := range inner {
+		switch {
+		case quote != 0:
+			if c == quote && (quote == '\'' || i == 0 || inner[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(inner[start:i]))
+			start = i + 1
+		}
+	}
+
+	// A trailing comma is allowed.
+	if last := strings.TrimSpace(inner[start:]); last != "" {
+		items = append(items, last)
+	}
+
+	return
+}
+
+// Reports whether an array has a closing bracket outside of any strings.
+func arrayClosed(raw string) bool {
+	var quote rune
+	for i, c := range raw {
+		switch {
+		case quote != 0:
+			if c == quote && (quote == '\'' || raw[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes a # comment, unless it is inside a string.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote && (quote == '\'' || line[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// Checks the final settings, however they were given, without opening any
+// sockets or files. Every problem is reported.
+func validateConfig() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	atLeast := map[string]int64{
+		"flush":             1,
+		"shutdown-timeout":  1,
+		"udp-max-size":      1,
+		"udp-rcvbuf":        0,
+		"udp-readers":       1,
+		"tcp-max-line":      1,
+		"tcp-timeout":       0,
+		"tcp-max-conns":     1,
+		"http-max-size":     1,
+		"ready-max-failing": 0,
+		"batch":             1,
+		"concurrency":       1,
+		"retry-size":        0,
+		"retry-age":         1,
+		"spool-size":        1,
+		"influxdb-batch":    1,
+	}
+
+	names := make([]string, 0, len(atLeast))
+	for name := range atLeast {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var v int64
+		switch n := flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+		case int:
+			v = int64(n)
+		case int64:
+			v = n
+		}
+
+		if v < atLeast[name] {
+			fail("-%s must be at least %d, got %d", name, atLeast[name], v)
+		}
+	}
+
+	errs = append(errs, checkPercentiles(*percentiles)...)
+
+	if !reStatsPrefix.MatchString(*statsPrefix) {
+		fail("invalid -stats-prefix %q, expected letters, digits, underscores and dots", *statsPrefix)
+	}
+
+	if _, err := parseListenSpecs(*listen); err != nil {
+		fail("%s", err)
+	}
+
+	if mode, err := strconv.ParseUint(*unixMode, 8, 32); err != nil || mode > 0777 {
+		fail("invalid -unix-mode %q, expected octal permissions (eg. \"0660\")", *unixMode)
+	}
+
+	if *unixOwner != "" {
+		if _, _, err := parseOwner(*unixOwner); err != nil {
+			fail("invalid -unix-owner %q: %s", *unixOwner, err)
+		}
+	}
+
+	if *spoolDir != "" && *retrySize <= 0 {
+		fail("the spool requires retries, specify a -retry-size greater than 0")
+	}
+
+	for _, name := range strings.Split(*backendNames, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "librato":
+			if *libratoUser == "" || *libratoToken == "" {
+				fail("the librato backend requires -user and -token")
+			}
+			if *libratoApi != "metrics" && *libratoApi != "measurements" {
+				fail("unknown librato api %q, expected \"metrics\" or \"measurements\"", *libratoApi)
+			}
+		case "proxy":
+			if *proxy == "" {
+				fail("the proxy backend requires -proxy")
+			}
+		case "graphite":
+			if *graphite == "" {
+				fail("the graphite backend requires -graphite")
+			}
+		case "prometheus":
+			if *prometheus == "" {
+				fail("the prometheus backend requires -prometheus")
+			}
+		case "influxdb":
+			if *influxdb == "" {
+				fail("the influxdb backend requires -influxdb")
+			}
+			if *influxDatabase == "" && *influxBucket == "" {
+				fail("the influxdb backend requires -influxdb-database or -influxdb-bucket")
+			}
+			if _, found := influxPrecisions[*influxPrecision]; !found {
+				fail("unknown influxdb precision %q, expected \"s\", \"ms\", \"us\" or \"ns\"", *influxPrecision)
+			}
+		default:
+			fail("unknown backend %q", name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Checks a comma separated list of percentiles.
+func checkPercentiles(s string) (errs []error) {
+	if s == "" {
+		return
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil || f <= 0.0 || f >= 100.0 {
+			errs = append(errs, fmt.Errorf("invalid percentile %q, expected a number between 0 and 100", p))
+		}
+	}
+
+	return
+}
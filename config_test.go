@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Saves the value of every flag, returning a func that restores them.
+func saveFlags() func() {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+
+	return func() {
+		flag.VisitAll(func(f *flag.Flag) { f.Value.Set(values[f.Name]) })
+	}
+}
+
+func writeConfig(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "statsd.toml")
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := make(map[string]bool)
+	for key, name := range configKeys {
+		if flag.Lookup(name) == nil {
+			t.Errorf("%s: unknown flag %s", key, name)
+		}
+		keys[name] = true
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "check-config", "version":
+		default:
+			if !keys[f.Name] && !strings.HasPrefix(f.Name, "test.") {
+				t.Errorf("-%s has no config setting", f.Name)
+			}
+		}
+	})
+}
+
+var parseConfigTests = []struct {
+	in       string
+	settings map[string]string
+	rules    string
+	errs     []string
+}{
+	{
+		"# statsd\nflush = 10\ndebug = true\n\n[librato]\nuser = \"me@example.com\" # inline\ntoken = 'a#b'\n",
+		map[string]string{"flush": "10", "debug": "true", "librato.user": "me@example.com", "librato.token": "a#b"},
+		"",
+		nil,
+	},
+	{
+		"listen = [\"udp://0.0.0.0:8125\", \"tcp://0.0.0.0:8125\"]\npercentiles = [95, 99.5]\n[librato]\ntags = [\n  \"env:prod\", # comment\n  \"region:us,east\",\n]\n",
+		map[string]string{"listen": "udp://0.0.0.0:8125,tcp://0.0.0.0:8125", "percentiles": "95,99.5", "librato.tags": "env:prod,region:us,east"},
+		"",
+		nil,
+	},
+	{
+		"percentiles = 95\n[unix]\nstream = \"/tmp/s.sock\"\n",
+		map[string]string{"percentiles": "95", "unix.stream": "/tmp/s.sock"},
+		"",
+		nil,
+	},
+	{
+		"flush = \"10\"\ndebug = 1\n[librato]\nuser = me\nbatch = [1]\n",
+		nil,
+		"",
+		[]string{
+			`test.toml:1: invalid flush: expected a number, got "10"`,
+			`test.toml:2: invalid debug: expected a boolean, got 1`,
+			`test.toml:4: invalid librato.user: expected a quoted string, number or boolean, got me`,
+			`test.toml:5: invalid librato.batch: expected a number, got an array`,
+		},
+	},
+	{
+		"flush = 10\nflush = 20\nflsh = 1\n[udp]\nsize = 1\nlisten\n",
+		nil,
+		"",
+		[]string{
+			`test.toml:2: flush is already set on line 1`,
+			`test.toml:3: unknown setting "flsh"`,
+			`test.toml:5: unknown setting "udp.size"`,
+			`test.toml:6: expected "key = value", "[section]" or "[[metrics]]", got "listen"`,
+		},
+	},
+	{
+		"listen = [\"udp://0.0.0.0:8125\"\n",
+		nil,
+		"",
+		[]string{`test.toml:1: invalid listen: unterminated array ["udp://0.0.0.0:8125"`},
+	},
+	{
+		"librato.user = \"me\"\ngraphite . prefix = \"app\"\n[udp]\nmax_size = 65_507\n[[metrics]]\nmatch = \"api.*\"\npercentiles = [50, 99.9]\n\n[[metrics]]\nmatch = \"debug.*\"\ndrop = true\n[tcp]\ntimeout = 1_0\n",
+		map[string]string{"librato.user": "me", "graphite.prefix": "app", "udp.max_size": "65507", "tcp.timeout": "10"},
+		`match "api.*" percentiles "50,99.9"; match "debug.*" drop`,
+		nil,
+	},
+	{
+		"flush = 1__0\n[[metrics]]\ndrop = 1\n[[metrics]]\nmatch = \"api\"\nmatch = \"a|b\"\npercentiles = [100]\nsize = 1\n[[rules]]\n",
+		nil,
+		"",
+		[]string{
+			`test.toml:1: invalid flush: expected a quoted string, number or boolean, got 1__0`,
+			`test.toml:3: invalid metrics.drop: expected a boolean, got 1`,
+			`test.toml:2: [[metrics]] requires a match`,
+			`test.toml:6: metrics.match is already set on line 5`,
+			`test.toml:7: invalid metrics.percentiles: invalid percentile "100", expected a number between 0 and 100`,
+			`test.toml:8: unknown setting "metrics.size"`,
+			`test.toml:9: unknown table [[rules]], expected [[metrics]]`,
+		},
+	},
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, s := range parseConfigTests {
+		settings, rules, err := parseConfig(strings.NewReader(s.in), "test.toml")
+
+		var errs []string
+		if err != nil {
+			errs = strings.Split(err.Error(), "\n")
+		}
+
+		var got map[string]string
+		for _, setting := range settings {
+			if got == nil {
+				got = make(map[string]string)
+			}
+			got[setting.key] = setting.value
+		}
+
+		if !reflect.DeepEqual(got, s.settings) || formatRules(rules) != s.rules || !reflect.DeepEqual(errs, s.errs) {
+			t.Errorf("%q: got %+v %q %q, expected %+v %q %q", s.in, got, formatRules(rules), errs, s.settings, s.rules, s.errs)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer saveFlags()()
+
+	path := writeConfig(t, `
+backends = ["proxy", "graphite"]
+flush = 10
+
+[proxy]
+address = "127.0.0.1:8125"
+
+[graphite]
+address = "carbon:2003"
+prefix = "app"
+`)
+
+	t.Setenv("CONFIG", path)
+	t.Setenv("GRAPHITE", "other:2003")
+	t.Setenv("LISTEN", "")
+	*listen, *libratoApi = "", ""
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *configPath != path {
+		t.Errorf("got config '%s', expected '%s' from the environment", *configPath, path)
+	}
+
+	if *backendNames != "proxy,graphite" || *interval != 10 || *proxy != "127.0.0.1:8125" || *graphitePrefix != "app" {
+		t.Errorf("got %s, %d, %s, %s, expected the config file's settings", *backendNames, *interval, *proxy, *graphitePrefix)
+	}
+
+	if *graphite != "other:2003" {
+		t.Errorf("got graphite '%s', expected the environment to take precedence", *graphite)
+	}
+
+	if *libratoApi != "metrics" || *listen != defaultListenSpecs(*address, *health, *unixgram, *unixStream) {
+		t.Errorf("got api '%s' and listen '%s', expected the defaults", *libratoApi, *listen)
+	}
+
+	if err := validateConfig(); err != nil {
+		t.Errorf("got %v, expected a valid config", err)
+	}
+
+	t.Setenv("CONFIG", writeConfig(t, "flush = 1.5\n"))
+	if err := loadConfig(); err == nil || !strings.Contains(err.Error(), "statsd.toml:1: invalid flush") {
+		t.Errorf("got %v, expected an invalid flush", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	defer saveFlags()()
+
+	*backendNames, *proxy, *listen = "proxy", "127.0.0.1:8125", "udp://0.0.0.0:8125"
+	if err := validateConfig(); err != nil {
+		t.Errorf("got %v, expected a valid config", err)
+	}
+
+	*backendNames, *proxy, *libratoUser, *libratoApi = "librato,influxdb,statsd", "", "", "tagged"
+	*influxdb, *influxPrecision = "http://localhost:8086", "m"
+	*listen, *interval, *percentiles, *unixMode, *spoolDir, *retrySize = "0.0.0.0:8125", 0, "95,100", "rw", "/tmp", 0
+
+	err := validateConfig()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+
+	expect := []string{
+		"-flush must be at least 1, got 0",
+		`invalid percentile "100", expected a number between 0 and 100`,
+		`invalid listener "0.0.0.0:8125", expected a protocol and address (eg. "udp://0.0.0.0:8125")`,
+		`invalid -unix-mode "rw", expected octal permissions (eg. "0660")`,
+		"the spool requires retries, specify a -retry-size greater than 0",
+		"the librato backend requires -user and -token",
+		`unknown librato api "tagged", expected "metrics" or "measurements"`,
+		"the influxdb backend requires -influxdb-database or -influxdb-bucket",
+		`unknown influxdb precision "m", expected "s", "ms", "us" or "ns"`,
+		`unknown backend "statsd"`,
+	}
+
+	if errs := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(errs, expect) {
+		t.Errorf("got %q, expected %q", errs, expect)
+	}
+}
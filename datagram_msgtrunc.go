@@ -0,0 +1,29 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Datagrams are read with recvmsg, which flags those larger than the read
+// buffer with MSG_TRUNC, so the buffer needs no room to spare.
+const datagramSlack = 0
+
+// Reads a datagram from a udp or unixgram socket, reporting whether it was
+// larger than b.
+func readDatagram(conn net.PacketConn, b []byte) (n int, truncated bool, err error) {
+	var flags int
+
+	switch c := conn.(type) {
+	case *net.UDPConn:
+		n, _, flags, _, err = c.ReadMsgUDP(b, nil)
+	case *net.UnixConn:
+		n, _, flags, _, err = c.ReadMsgUnix(b, nil)
+	default:
+		n, _, err = conn.ReadFrom(b)
+	}
+
+	return n, flags&syscall.MSG_TRUNC != 0, err
+}
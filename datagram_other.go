@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"net"
+)
+
+// Without MSG_TRUNC, the read buffer has a byte to spare past the maximum
+// size, which only a datagram larger than the maximum fills.
+const datagramSlack = 1
+
+// Reads a datagram from a udp or unixgram socket, reporting whether it was
+// larger than b without its spare byte.
+func readDatagram(conn net.PacketConn, b []byte) (n int, truncated bool, err error) {
+	n, _, err = conn.ReadFrom(b)
+
+	// Some platforms also fail the read of a datagram that didn't fit, after
+	// filling the buffer.
+	if n == len(b) {
+		return n - 1, true, nil
+	}
+
+	return n, false, err
+}
@@ -0,0 +1,3 @@
+module github.com/jcoene/statsd-librato
+
+go 1.23
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The most unsent data the graphite backend holds on to while carbon is
+// unreachable.
+const graphiteMaxPending = 4 * 1024 * 1024
+
+// Sends metrics to carbon using the plaintext protocol, laid out the same
+// way as the graphite backend of Etsy's statsd.
+type graphiteBackend struct {
+	status
+	address string
+	gauges  map[string]float64
+	pending []byte
+}
+
+func newGraphiteBackend(address string) (b *graphiteBackend, err error) {
+	if address == "" {
+		return nil, fmt.Errorf("specify a graphite address with -graphite or the GRAPHITE environment variable")
+	}
+
+	log.Printf("sending metrics to graphite at %s\n", address)
+
+	return &graphiteBackend{address: address, gauges: make(map[string]float64)}, nil
+}
+
+// Picks up a change to -graphite.
+func (b *graphiteBackend) reload() error {
+	if *graphite == "" {
+		return fmt.Errorf("specify a graphite address with -graphite or the GRAPHITE environment variable")
+	}
+
+	if *graphite != b.address {
+		b.address = *graphite
+		log.Printf("sending metrics to graphite at %s\n", b.address)
+	}
+
+	return nil
+}
+
+// Deletes current values of gauges.
+func (b *graphiteBackend) delete(bucket string, match func(string) bool) []string {
+	if bucket == "g" {
+		return deleteKeys(b.gauges, match)
+	}
+
+	return nil
+}
+
+func (b *graphiteBackend) Name() string {
+	return "graphite"
+}
+
+func (b *graphiteBackend) Flush(s *snapshot) error {
+	return b.record(b.flush(s))
+}
+
+func (b *graphiteBackend) flush(s *snapshot) (err error) {
+	applyGauges(b.gauges, s)
+
+	lines := buildGraphite(&snapshot{time: s.time, counters: s.counters, gauges: b.gauges, timers: s.timers, sets: s.sets})
+
+	// Lines that couldn't be sent keep their original timestamps, so they
+	// can simply be sent ahead of this flush.
+	msg := append(b.pending, []byte(strings.Join(lines, ""))...)
+	b.pending = nil
+
+	if len(msg) == 0 {
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if len(msg) > graphiteMaxPending {
+			log.Printf("dropping %d bytes of unsent graphite data\n", len(msg))
+			return
+		}
+		b.pending = msg
+	}()
+
+	conn, err := net.DialTimeout("tcp", b.address, 10*time.Second)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(backendTimeout()))
+
+	n, err := conn.Write(msg)
+	if err != nil {
+		return
+	}
+
+	if n != len(msg) {
+		return fmt.Errorf("wrote %d of %d bytes", n, len(msg))
+	}
+
+	log.Printf("%d measurements sent to graphite at %s\n", len(lines), b.address)
+
+	return
+}
+
+// Builds plaintext lines for every metric in the snapshot:
+//
+//	stats.counters.<name>.count, stats.counters.<name>.rate
+//	stats.gauges.<name>
+//	stats.sets.<name>.count
+//	stats.timers.<name>.<stat> and <stat>_<percentile>
+func buildGraphite(s *snapshot) (lines []string) {
+	ts := s.time.Unix()
+	seconds := float64(*interval)
+
+	for k, v := range s.counters {
+		lines = append(lines,
+			buildGraphiteLine(*graphiteCounterPrefix, k, "count", v, ts),
+			buildGraphiteLine(*graphiteCounterPrefix, k, "rate", v/seconds, ts))
+	}
+
+	for k, v := range s.gauges {
+		lines = append(lines, buildGraphiteLine(*graphiteGaugePrefix, k, "", v, ts))
+	}
+
+	for k, ms := range s.sets {
+		lines = append(lines, buildGraphiteLine(*graphiteSetPrefix, k, "count", float64(len(ms)), ts))
+	}
+
+	for k, t := range s.timers {
+		for _, pct := range tilesFor(k) {
+			g := buildComplexGauge(k, t, pct)
+			if g == nil {
+				continue
+			}
+
+			mean := g.Sum / float64(g.Count)
+
+			if pct == 100.0 {
+				std := 0.0
+				if v := (g.SumSquares / float64(g.Count)) - (mean * mean); v > 0 {
+					std = math.Sqrt(v)
+				}
+
+				lines = append(lines,
+					buildGraphiteLine(*graphiteTimerPrefix, k, "count", float64(g.Count), ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "count_ps", float64(g.Count)/seconds, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "lower", g.Min, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "upper", g.Max, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "sum", g.Sum, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "sum_squares", g.SumSquares, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "mean", mean, ts),
+					buildGraphiteLine(*graphiteTimerPrefix, k, "std", std, ts))
+				continue
+			}
+
+			p := graphitePercentile(pct)
+			lines = append(lines,
+				buildGraphiteLine(*graphiteTimerPrefix, k, "count_"+p, float64(g.Count), ts),
+				buildGraphiteLine(*graphiteTimerPrefix, k, "upper_"+p, g.Max, ts),
+				buildGraphiteLine(*graphiteTimerPrefix, k, "sum_"+p, g.Sum, ts),
+				buildGraphiteLine(*graphiteTimerPrefix, k, "sum_squares_"+p, g.SumSquares, ts),
+				buildGraphiteLine(*graphiteTimerPrefix, k, "mean_"+p, mean, ts))
+		}
+	}
+
+	return
+}
+
+// Formats a percentile the way Etsy's statsd names its timer stats, with the
+// decimal point replaced by an underscore.
+// 99.9  => "99_9"
+// 99.95 => "99_95"
+func graphitePercentile(pct float64) string {
+	return strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", 1)
+}
+
+// Builds a single plaintext line. Tags and any source prefix are sent as
+// graphite tags.
+// "counters", "my_source,my_key|#env:prod", "count", 1, 1400000000 =>
+// "stats.counters.my_key.count;env=prod;source=my_source 1 1400000000\n"
+func buildGraphiteLine(prefix string, key string, stat string, value float64, ts int64) string {
+	name, tags := parseKey(key)
+	name, source := parseSource(name)
+
+	path := make([]string, 0, 4)
+	for _, p := range []string{*graphitePrefix, prefix, name, stat} {
+		if p != "" {
+			path = append(path, p)
+		}
+	}
+
+	ss := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 2 {
+			ss = append(ss, kv[0]+"="+kv[1])
+		} else {
+			ss = append(ss, kv[0]+"=true")
+		}
+	}
+	if source != "" {
+		ss = append(ss, "source="+source)
+	}
+	sort.Strings(ss)
+
+	series := strings.Join(path, ".")
+	if len(ss) > 0 {
+		series += ";" + strings.Join(ss, ";")
+	}
+
+	return fmt.Sprintf("%s %s %d\n", series, strconv.FormatFloat(value, 'f', -1, 64), ts)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var buildGraphiteLineTests = []struct {
+	prefix string
+	key    string
+	stat   string
+	value  float64
+	expect string
+}{
+	{"counters", "my.key", "count", 1, "stats.counters.my.key.count 1 1400000000\n"},
+	{"gauges", "my.key", "", 2.5, "stats.gauges.my.key 2.5 1400000000\n"},
+	{"", "my.key", "", 2.5, "stats.my.key 2.5 1400000000\n"},
+	{"counters", "app01,my.key", "rate", 0.1, "stats.counters.my.key.rate;source=app01 0.1 1400000000\n"},
+	{"timers", "my.key|#role:web,canary", "mean_95", 3, "stats.timers.my.key.mean_95;canary=true;role=web 3 1400000000\n"},
+}
+
+func TestBuildGraphiteLine(t *testing.T) {
+	for _, s := range buildGraphiteLineTests {
+		got := buildGraphiteLine(s.prefix, s.key, s.stat, s.value, 1400000000)
+		if got != s.expect {
+			t.Errorf("%s: got '%s', expected '%s'", s.key, got, s.expect)
+		}
+	}
+}
+
+var graphitePercentileTests = []struct {
+	pct    float64
+	expect string
+}{
+	{95, "95"},
+	{99.5, "99_5"},
+	{99.9, "99_9"},
+	{99.95, "99_95"},
+	{99.99, "99_99"},
+}
+
+func TestGraphitePercentile(t *testing.T) {
+	for _, s := range graphitePercentileTests {
+		if got := graphitePercentile(s.pct); got != s.expect {
+			t.Errorf("%v: got '%s', expected '%s'", s.pct, got, s.expect)
+		}
+	}
+}
+
+func TestBuildGraphite(t *testing.T) {
+	saved := tiles
+	defer func() { tiles = saved }()
+	tiles = []float64{100.0, 50.0}
+
+	flushed := *interval
+	defer func() { *interval = flushed }()
+	*interval = 10
+
+	s := &snapshot{
+		time:     time.Unix(1400000000, 0),
+		counters: map[string]float64{"a": 20},
+		gauges:   map[string]float64{"b": 3},
+		timers:   map[string][]float64{"c": {10, 20, 30, 40}},
+		sets:     map[string]map[string]struct{}{"d": {"x": {}, "y": {}}},
+	}
+
+	lines := buildGraphite(s)
+	sort.Strings(lines)
+
+	expect := []string{
+		"stats.counters.a.count 20 1400000000\n",
+		"stats.counters.a.rate 2 1400000000\n",
+		"stats.gauges.b 3 1400000000\n",
+		"stats.sets.d.count 2 1400000000\n",
+		"stats.timers.c.count 4 1400000000\n",
+		"stats.timers.c.count_50 2 1400000000\n",
+		"stats.timers.c.count_ps 0.4 1400000000\n",
+		"stats.timers.c.lower 10 1400000000\n",
+		"stats.timers.c.mean 25 1400000000\n",
+		"stats.timers.c.mean_50 15 1400000000\n",
+		"stats.timers.c.std 11.180339887498949 1400000000\n",
+		"stats.timers.c.sum 100 1400000000\n",
+		"stats.timers.c.sum_50 30 1400000000\n",
+		"stats.timers.c.sum_squares 3000 1400000000\n",
+		"stats.timers.c.sum_squares_50 500 1400000000\n",
+		"stats.timers.c.upper 40 1400000000\n",
+		"stats.timers.c.upper_50 20 1400000000\n",
+	}
+
+	if strings.Join(lines, "") != strings.Join(expect, "") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(lines, ""), strings.Join(expect, ""))
+	}
+}
+
+func TestGraphiteBackendFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		received <- string(buf)
+	}()
+
+	b, _ := newGraphiteBackend(l.Addr().String())
+	b.pending = []byte("stats.gauges.old 1 1399999990\n")
+
+	err = b.Flush(&snapshot{
+		time:   time.Unix(1400000000, 0),
+		gauges: map[string]float64{"a": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; got != "stats.gauges.old 1 1399999990\nstats.gauges.a 1 1400000000\n" {
+		t.Errorf("got '%s', expected the pending and new lines", got)
+	}
+
+	if b.pending != nil {
+		t.Errorf("expected nothing to be pending")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A listener that was configured, and the input reading from it if it could
+// be opened.
+type listenerState struct {
+	spec listenSpec
+	in   *input
+}
+
+type listenerStates struct {
+	mu     sync.Mutex
+	states []listenerState
+}
+
+// The most intervals a flush may run for, holding back the ones after it,
+// before the daemon isn't ready. A flush that hangs never records a result,
+// so it wouldn't otherwise show up as failing.
+const readyMaxHeld = 3
+
+// The listeners started by startListeners, which the health endpoints
+// report on.
+var listeners = &listenerStates{}
+
+func (l *listenerStates) set(states []listenerState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.states = states
+}
+
+func (l *listenerStates) get() []listenerState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.states
+}
+
+type HealthResponse struct {
+	Status        string           `json:"status"`
+	Errors        []string         `json:"errors,omitempty"`
+	Listeners     []HealthListener `json:"listeners"`
+	Pending       int              `json:"pending"`
+	FlushingSince *time.Time       `json:"flushing_since,omitempty"`
+	Held          int              `json:"held"`
+	Backends      []HealthBackend  `json:"backends"`
+}
+
+type HealthListener struct {
+	Listener string `json:"listener"`
+	Bound    bool   `json:"bound"`
+}
+
+type HealthBackend struct {
+	Name         string     `json:"name"`
+	LastFlush    *time.Time `json:"last_flush,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Reports on the listeners, the packets waiting to be flushed and the last
+// flush to each backend. The errors are the reasons the daemon isn't live,
+// which is when a listener isn't bound, and when ready is set also the
+// reasons it isn't ready to receive traffic: it has been marked down through
+// the admin interface, flushes to a backend have been failing for longer
+// than readyMaxFailing, or the running flush has held back readyMaxHeld
+// intervals.
+func checkHealth(ready bool, now time.Time) (resp HealthResponse) {
+	for _, l := range listeners.get() {
+		bound := l.in != nil && l.in.bound()
+		resp.Listeners = append(resp.Listeners, HealthListener{l.spec.String(), bound})
+		if !bound {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("listener %s isn't bound", l.spec))
+		}
+	}
+
+	resp.Pending = aggregator.Pending()
+
+	started, intervals, held := flushes.state()
+	resp.FlushingSince, resp.Held = timeOrNil(started), held
+	if ready && intervals >= readyMaxHeld {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("a flush has been running since %s, holding back %d intervals", started.Format(time.RFC3339), intervals))
+	}
+
+	for _, b := range backends {
+		hb := HealthBackend{Name: b.Name()}
+
+		if s, ok := b.(reporter); ok {
+			r := s.report()
+			hb.LastFlush, hb.LastSuccess, hb.FailingSince = timeOrNil(r.last), timeOrNil(r.success), timeOrNil(r.failing)
+			if r.err != nil {
+				hb.Error = r.err.Error()
+			}
+
+			limit := time.Duration(*readyMaxFailing) * time.Second
+			if ready && limit > 0 && !r.failing.IsZero() && now.Sub(r.failing) > limit {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("flushes to %s have been failing since %s", b.Name(), r.failing.Format(time.RFC3339)))
+			}
+		}
+
+		resp.Backends = append(resp.Backends, hb)
+	}
+
+	if ready && down.Load() {
+		resp.Errors = append(resp.Errors, "marked down through the admin interface")
+	}
+
+	resp.Status = "ok"
+	if len(resp.Errors) > 0 {
+		resp.Status = "failing"
+	}
+
+	return
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// Serves only the health and readiness endpoints, for probes, without
+// accepting metrics.
+func newHealthServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+
+	return &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+// Liveness, which fails when a listener isn't bound.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, checkHealth(false, time.Now()))
+}
+
+// Readiness, which also fails when the daemon has been marked down or a
+// backend has been failing for too long.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, checkHealth(true, time.Now()))
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, resp HealthResponse) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeHttp(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := http.StatusOK
+	if len(resp.Errors) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
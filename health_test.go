@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+	defer down.Store(false)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	inputs := startListeners([]listenSpec{{"tcp", "127.0.0.1:0"}, {"tcp", taken.Addr().String()}})
+	defer func() {
+		for _, in := range inputs {
+			in.Close()
+		}
+	}()
+
+	now := time.Now()
+	ok := &testBackend{name: "a"}
+	ok.Flush(&snapshot{})
+	failing := &testBackend{name: "b", err: errors.New("failed")}
+	failing.Flush(&snapshot{})
+	failing.failing = now.Add(-10 * time.Minute)
+	backends = []Backend{ok, failing}
+
+	resp := checkHealth(false, now)
+
+	expect := []HealthListener{{"tcp://" + inputs[0].spec.address, true}, {"tcp://" + taken.Addr().String(), false}}
+	if !reflect.DeepEqual(resp.Listeners, expect) {
+		t.Errorf("got %+v, expected %+v", resp.Listeners, expect)
+	}
+
+	if resp.Status != "failing" || len(resp.Errors) != 1 || resp.Errors[0] != "listener tcp://"+taken.Addr().String()+" isn't bound" {
+		t.Errorf("got %s %q, expected the unbound listener to fail liveness", resp.Status, resp.Errors)
+	}
+
+	if b := resp.Backends[0]; b.Name != "a" || b.LastSuccess == nil || b.FailingSince != nil || b.Error != "" {
+		t.Errorf("got %+v, expected a successful flush", b)
+	}
+
+	if b := resp.Backends[1]; b.Name != "b" || b.LastSuccess != nil || b.FailingSince == nil || b.Error != "failed" {
+		t.Errorf("got %+v, expected a failed flush", b)
+	}
+
+	// Once the listener that failed is dropped, only readiness fails.
+	listeners.set(listeners.get()[:1])
+
+	if resp := checkHealth(false, now); resp.Status != "ok" || len(resp.Errors) != 0 {
+		t.Errorf("got %s %q, expected to be live", resp.Status, resp.Errors)
+	}
+
+	down.Store(true)
+	resp = checkHealth(true, now)
+	expectErrors := []string{
+		"flushes to b have been failing since " + failing.failing.Format(time.RFC3339),
+		"marked down through the admin interface",
+	}
+	if resp.Status != "failing" || !reflect.DeepEqual(resp.Errors, expectErrors) {
+		t.Errorf("got %s %q, expected %q", resp.Status, resp.Errors, expectErrors)
+	}
+
+	down.Store(false)
+	failing.failing = now.Add(-time.Minute)
+	if resp := checkHealth(true, now); resp.Status != "ok" {
+		t.Errorf("got %s %q, expected a backend failing for a minute to be ready", resp.Status, resp.Errors)
+	}
+
+	inputs[0].Close()
+	if resp := checkHealth(false, now); resp.Listeners[0].Bound {
+		t.Errorf("expected a closed listener not to be bound")
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+	defer down.Store(false)
+
+	backends = nil
+	listeners.set(nil)
+
+	server := httptest.NewServer(newHttpServer().Handler)
+	defer server.Close()
+
+	down.Store(true)
+
+	for path, code := range map[string]int{"/health": http.StatusOK, "/ready": http.StatusServiceUnavailable} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body HealthResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != code {
+			t.Errorf("%s: got %d %+v, expected %d", path, resp.StatusCode, body, code)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/health", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got %d, expected 405 for a POST", resp.StatusCode)
+	}
+}
+
+func TestCheckHealthHeldFlush(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+
+	backends = nil
+	listeners.set(nil)
+
+	started := time.Now().Add(-5 * time.Minute)
+	flushes.mu.Lock()
+	flushes.running, flushes.started = true, started
+	flushes.pending, flushes.held = &snapshot{counters: map[string]float64{"a": 1}}, readyMaxHeld
+	flushes.mu.Unlock()
+
+	defer func() {
+		flushes.mu.Lock()
+		flushes.running, flushes.started, flushes.pending, flushes.held = false, time.Time{}, nil, 0
+		flushes.mu.Unlock()
+	}()
+
+	resp := checkHealth(true, time.Now())
+	expect := []string{"a flush has been running since " + started.Format(time.RFC3339) + ", holding back 3 intervals"}
+	if resp.Status != "failing" || !reflect.DeepEqual(resp.Errors, expect) {
+		t.Errorf("got %s %q, expected %q", resp.Status, resp.Errors, expect)
+	}
+
+	if resp.FlushingSince == nil || !resp.FlushingSince.Equal(started) || resp.Held != 1 {
+		t.Errorf("got %v and %d held, expected the running flush", resp.FlushingSince, resp.Held)
+	}
+
+	if resp := checkHealth(false, time.Now()); resp.Status != "ok" {
+		t.Errorf("got %s %q, expected a hung flush to stay live", resp.Status, resp.Errors)
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+
+	backends = nil
+	listeners.set(nil)
+
+	server := httptest.NewServer(newHealthServer().Handler)
+	defer server.Close()
+
+	for path, code := range map[string]int{"/health": http.StatusOK, "/ready": http.StatusOK, "/metrics": http.StatusNotFound} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != code {
+			t.Errorf("%s: got %d, expected %d", path, resp.StatusCode, code)
+		}
+	}
+}
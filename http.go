@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A single line, which must be a complete metric rather than contain one.
+var reLine = regexp.MustCompile("^" + re.String() + "$")
+
+// A metric posted in a json array. A gauge with a numeric value is set to
+// that value, even a negative one, unless delta is set to adjust it instead.
+type HttpMetric struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Value      interface{} `json:"value"`
+	SampleRate float64     `json:"sample_rate,omitempty"`
+	Tags       []string    `json:"tags,omitempty"`
+	Delta      bool        `json:"delta,omitempty"`
+}
+
+type HttpResponse struct {
+	Accepted int         `json:"accepted"`
+	Errors   []HttpError `json:"errors,omitempty"`
+}
+
+// An invalid line of a statsd payload, or element of a json array, counting
+// from 1. Errors with the request as a whole have no line.
+type HttpError struct {
+	Line  int    `json:"line,omitempty"`
+	Error string `json:"error"`
+}
+
+var httpTypes = map[string]string{
+	"c": "c", "counter": "c",
+	"g": "g", "gauge": "g",
+	"ms": "ms", "timer": "ms",
+	"s": "s", "set": "s",
+}
+
+func newHttpServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleHttp)
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+
+	return &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+// Accepts newline separated statsd lines, or a json array of metrics with a
+// json content type. Valid metrics are recorded even when others are
+// invalid, and the invalid ones are listed in the response.
+func handleHttp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeHttp(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if *httpToken != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(*httpToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeHttp(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *httpMaxSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeHttp(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %d bytes", *httpMaxSize))
+			return
+		}
+		writeHttp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	packetsReceived.Add(1)
+
+	var lines []string
+	var absolute []bool
+	var resp HttpResponse
+
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/json" {
+		var ms []HttpMetric
+		if err := json.Unmarshal(body, &ms); err != nil {
+			badLines.Add(1)
+			writeHttp(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+
+		for _, m := range ms {
+			lines = append(lines, buildHttpLine(m))
+			absolute = append(absolute, absoluteGauge(m))
+		}
+	} else {
+		lines = strings.Split(string(bytes.TrimRight(body, "\r\n")), "\n")
+	}
+
+	for i, line := range lines {
+		ps, err := parseHttpLine(strings.TrimRight(line, "\r"))
+		if err != nil {
+			resp.Errors = append(resp.Errors, HttpError{i + 1, err.Error()})
+			continue
+		}
+
+		for _, p := range ps {
+			if i < len(absolute) && absolute[i] {
+				p.relative = false
+			}
+			if *debug {
+				log.Printf("received packet: %+v\n", p)
+			}
+			if !dropMetric(p) {
+				aggregator.Add(p)
+			}
+		}
+		resp.Accepted += len(ps)
+	}
+
+	metricsReceived.Add(int64(resp.Accepted))
+	badLines.Add(int64(len(resp.Errors)))
+
+	status := http.StatusOK
+	if resp.Accepted == 0 && len(resp.Errors) > 0 {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Reports whether a posted metric sets a gauge to a numeric value, which in a
+// statsd line would adjust the gauge when negative.
+// {"name": "temp", "type": "gauge", "value": -5} => true
+func absoluteGauge(m HttpMetric) bool {
+	_, numeric := m.Value.(float64)
+	return numeric && httpTypes[m.Type] == "g" && !m.Delta
+}
+
+// Parses a single line, which must be a complete and valid metric.
+func parseHttpLine(line string) ([]packet, error) {
+	if line == "" {
+		return nil, errors.New("empty line")
+	}
+
+	if !reLine.MatchString(line) {
+		return nil, fmt.Errorf("invalid metric %q, expected \"name:value|type\"", line)
+	}
+
+	ps := parsePacket(line)
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("invalid value in %q", line)
+	}
+
+	return ps, nil
+}
+
+// Converts a posted metric to a statsd line, so that it is validated and
+// parsed the same way.
+// {"name": "hits", "type": "counter", "value": 1, "sample_rate": 0.5} => "hits:1|c|@0.5"
+func buildHttpLine(m HttpMetric) string {
+	var value string
+	switch v := m.Value.(type) {
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+		if m.Delta && v >= 0 {
+			value = "+" + value
+		}
+	case string:
+		value = v
+	}
+
+	t, found := httpTypes[m.Type]
+	if !found {
+		t = m.Type
+	}
+
+	line := m.Name + ":" + value + "|" + t
+	if m.SampleRate != 0 {
+		line += "|@" + strconv.FormatFloat(m.SampleRate, 'f', -1, 64)
+	}
+	if len(m.Tags) > 0 {
+		line += "|#" + strings.Join(m.Tags, ",")
+	}
+
+	return line
+}
+
+func writeHttp(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(HttpResponse{Errors: []HttpError{{Error: msg}}})
+}
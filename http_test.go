@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var buildHttpLineTests = []struct {
+	in     HttpMetric
+	expect string
+}{
+	{HttpMetric{Name: "hits", Type: "c", Value: 1.0}, "hits:1|c"},
+	{HttpMetric{Name: "hits", Type: "counter", Value: 1.0, SampleRate: 0.5}, "hits:1|c|@0.5"},
+	{HttpMetric{Name: "depth", Type: "gauge", Value: "-2"}, "depth:-2|g"},
+	{HttpMetric{Name: "depth", Type: "g", Value: 2.0, Delta: true}, "depth:+2|g"},
+	{HttpMetric{Name: "depth", Type: "g", Value: -2.0, Delta: true}, "depth:-2|g"},
+	{HttpMetric{Name: "users", Type: "set", Value: "bob"}, "users:bob|s"},
+	{HttpMetric{Name: "req", Type: "ms", Value: 1.25, Tags: []string{"env:prod", "canary"}}, "req:1.25|ms|#env:prod,canary"},
+}
+
+func TestBuildHttpLine(t *testing.T) {
+	for _, s := range buildHttpLineTests {
+		if line := buildHttpLine(s.in); line != s.expect {
+			t.Errorf("%+v: got '%s', expected '%s'", s.in, line, s.expect)
+		}
+	}
+}
+
+var handleHttpTests = []struct {
+	contentType string
+	body        string
+	status      int
+	resp        HttpResponse
+	names       []string
+}{
+	{
+		"text/plain", "a:1|c\nb:2|g\r\n",
+		200, HttpResponse{Accepted: 2}, []string{"a", "b"},
+	},
+	{
+		"text/plain", "a:1|c\nbad line:1|c\nb:x|g\n",
+		200, HttpResponse{Accepted: 1, Errors: []HttpError{
+			{2, `invalid metric "bad line:1|c", expected "name:value|type"`},
+			{3, `invalid value in "b:x|g"`},
+		}}, []string{"a"},
+	},
+	{
+		"text/plain", "\n",
+		400, HttpResponse{Errors: []HttpError{{1, "empty line"}}}, nil,
+	},
+	{
+		"application/json; charset=utf-8", `[{"name": "a", "type": "counter", "value": 2}, {"name": "b", "type": "histogram", "value": 1}]`,
+		200, HttpResponse{Accepted: 1, Errors: []HttpError{{2, `invalid metric "b:1|histogram", expected "name:value|type"`}}}, []string{"a"},
+	},
+	{
+		"application/json", `{"name": "a"}`,
+		400, HttpResponse{Errors: []HttpError{{0, "invalid json: json: cannot unmarshal object into Go value of type []main.HttpMetric"}}}, nil,
+	},
+}
+
+func TestHandleHttp(t *testing.T) {
+	for _, s := range handleHttpTests {
+		aggregator.Snapshot()
+
+		r := httptest.NewRequest("POST", "/metrics", strings.NewReader(s.body))
+		r.Header.Set("Content-Type", s.contentType)
+		w := httptest.NewRecorder()
+		handleHttp(w, r)
+
+		var resp HttpResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if w.Code != s.status || !reflect.DeepEqual(resp, s.resp) {
+			t.Errorf("%q: got %d %+v, expected %d %+v", s.body, w.Code, resp, s.status, s.resp)
+		}
+
+		var names []string
+		snap := aggregator.Snapshot()
+		for k := range snap.counters {
+			names = append(names, k)
+		}
+		for k := range snap.gauges {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, s.names) {
+			t.Errorf("%q: got metrics %+v, expected %+v", s.body, names, s.names)
+		}
+	}
+}
+
+func TestHandleHttpGauges(t *testing.T) {
+	aggregator.Snapshot()
+
+	body := `[{"name": "temp", "type": "gauge", "value": 10}, {"name": "temp", "type": "gauge", "value": -5},
+		{"name": "depth", "type": "g", "value": 3}, {"name": "depth", "type": "g", "value": -1, "delta": true}]`
+	r := httptest.NewRequest("POST", "/metrics", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	handleHttp(httptest.NewRecorder(), r)
+
+	s := aggregator.Snapshot()
+	if !reflect.DeepEqual(s.gauges, map[string]float64{"temp": -5, "depth": 2}) || s.deltas["temp"] || s.deltas["depth"] {
+		t.Errorf("got %+v %+v, expected temp set to -5 and depth adjusted to 2", s.gauges, s.deltas)
+	}
+}
+
+func TestHandleHttpLimits(t *testing.T) {
+	token, size := *httpToken, *httpMaxSize
+	defer func() { *httpToken, *httpMaxSize = token, size }()
+	*httpToken, *httpMaxSize = "secret", 8
+
+	aggregator.Snapshot()
+
+	w := httptest.NewRecorder()
+	handleHttp(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d, expected 405 for a GET", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleHttp(w, httptest.NewRequest("POST", "/metrics", strings.NewReader("a:1|c")))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, expected 401 without a token", w.Code)
+	}
+
+	r := httptest.NewRequest("POST", "/metrics", strings.NewReader("a:1|c"))
+	r.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	handleHttp(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, expected 401 with the wrong token", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/metrics", strings.NewReader("a:1|c\nb:2|c"))
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handleHttp(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d, expected 413 for a large body", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/metrics", strings.NewReader("a:1|c"))
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handleHttp(w, r)
+	if w.Code != http.StatusOK || aggregator.Snapshot().Count() != 1 {
+		t.Errorf("got %d, expected 200 and a packet", w.Code)
+	}
+}
+
+func TestHttpListener(t *testing.T) {
+	aggregator.Snapshot()
+
+	in, err := openListener(listenSpec{"http", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.start()
+	defer in.Close()
+
+	resp, err := http.Post("http://"+in.spec.address+"/metrics", "text/plain", strings.NewReader("a:1|c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if s := aggregator.Snapshot(); resp.StatusCode != http.StatusOK || s.Count() != 1 || s.counters["a"] != 1 {
+		t.Errorf("got %d %+v, expected 200 and counter a", resp.StatusCode, s)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The most unsent lines the influxdb backend holds on to while influxdb is
+// unreachable.
+const influxMaxPending = 100000
+
+// Writes metrics to an influxdb http write endpoint in line protocol, using
+// the same measurements that are built for librato. A bucket selects the v2
+// api and a database the v1 api.
+type influxBackend struct {
+	status
+	url     string
+	gauges  map[string]float64
+	pending []string
+}
+
+var influxPrecisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+func newInfluxBackend(address string) (b *influxBackend, err error) {
+	if address == "" {
+		return nil, fmt.Errorf("specify an influxdb url with -influxdb or the INFLUXDB environment variable")
+	}
+
+	u, err := buildInfluxUrl(address)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("sending metrics to influxdb at %s\n", address)
+
+	b = &influxBackend{
+		url:    u,
+		gauges: make(map[string]float64),
+	}
+
+	return
+}
+
+// Builds the url to write to, with the api version and query parameters that
+// the settings call for.
+func buildInfluxUrl(address string) (string, error) {
+	if _, f := influxPrecisions[*influxPrecision]; !f {
+		return "", fmt.Errorf("unknown influxdb precision %q, expected \"s\", \"ms\", \"us\" or \"ns\"", *influxPrecision)
+	}
+
+	q := url.Values{}
+	q.Set("precision", *influxPrecision)
+
+	path := "/write"
+	switch {
+	case *influxBucket != "":
+		path = "/api/v2/write"
+		q.Set("bucket", *influxBucket)
+		if *influxOrg != "" {
+			q.Set("org", *influxOrg)
+		}
+	case *influxDatabase != "":
+		q.Set("db", *influxDatabase)
+	default:
+		return "", fmt.Errorf("specify an influxdb database with -influxdb-database or a bucket with -influxdb-bucket")
+	}
+
+	return strings.TrimRight(address, "/") + path + "?" + q.Encode(), nil
+}
+
+// Picks up changes to the address, database, bucket and precision.
+func (b *influxBackend) reload() error {
+	if *influxdb == "" {
+		return fmt.Errorf("specify an influxdb url with -influxdb or the INFLUXDB environment variable")
+	}
+
+	u, err := buildInfluxUrl(*influxdb)
+	if err != nil {
+		return err
+	}
+
+	if u != b.url {
+		b.url = u
+		log.Printf("sending metrics to influxdb at %s\n", *influxdb)
+	}
+
+	return nil
+}
+
+// Deletes current values of gauges.
+func (b *influxBackend) delete(bucket string, match func(string) bool) []string {
+	if bucket == "g" {
+		return deleteKeys(b.gauges, match)
+	}
+
+	return nil
+}
+
+func (b *influxBackend) Name() string {
+	return "influxdb"
+}
+
+func (b *influxBackend) Flush(s *snapshot) error {
+	return b.record(b.flush(s))
+}
+
+func (b *influxBackend) flush(s *snapshot) (err error) {
+	applyGauges(b.gauges, s)
+
+	m := buildMeasurement(&snapshot{counters: s.counters, gauges: b.gauges, timers: s.timers, sets: s.sets})
+
+	// Lines that couldn't be sent keep their original timestamps, so they
+	// can simply be sent ahead of this flush.
+	lines := append(b.pending, buildInflux(m, s.time)...)
+	b.pending = nil
+
+	if len(lines) == 0 {
+		return
+	}
+
+	var (
+		errs   batchErrors
+		failed []string
+	)
+	count, size := 0, max(*influxBatch, 1)
+	batches := (len(lines) + size - 1) / size
+
+	for i := 0; i < len(lines); i += size {
+		batch := lines[i:min(i+size, len(lines))]
+
+		if e := b.write(batch); e != nil {
+			errs = append(errs, fmt.Errorf("batch %d of %d (%d measurements): %s", i/size+1, batches, len(batch), e))
+			if retryable(e) {
+				failed = append(failed, batch...)
+			}
+			continue
+		}
+		count += len(batch)
+	}
+
+	if count > 0 {
+		log.Printf("%d measurements sent to influxdb in %d batches\n", count, batches)
+	}
+
+	if n := len(failed) - influxMaxPending; n > 0 {
+		log.Printf("dropping %d unsent influxdb lines\n", n)
+		failed = failed[n:]
+	}
+	b.pending = failed
+
+	if len(errs) > 0 {
+		err = errs
+	}
+
+	return
+}
+
+func (b *influxBackend) write(lines []string) (err error) {
+	body := strings.Join(lines, "")
+
+	if *debug {
+		log.Printf("sending lines:\n%s", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.url, bytes.NewBufferString(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "statsd/1.0")
+	if *influxToken != "" {
+		req.Header.Set("Authorization", "Token "+*influxToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		raw, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, string(raw))}
+	}
+
+	return
+}
+
+// Converts a measurement to line protocol. Counters and gauges have a single
+// value field, timers have a field for each statistic, and the source and
+// tags become influxdb tags.
+func buildInflux(m *Measurement, t time.Time) (lines []string) {
+	ts := t.UnixNano() / int64(influxPrecisions[*influxPrecision])
+
+	for _, c := range m.Counters {
+		lines = append(lines, buildInfluxLine(c.Name, sourceOr(c.Source, m.Source), c.Tags, "value="+formatInflux(c.Value), ts))
+	}
+
+	for _, g := range m.Gauges {
+		switch g := g.(type) {
+		case *Gauge:
+			lines = append(lines, buildInfluxLine(g.Name, sourceOr(g.Source, m.Source), g.Tags, "value="+formatInflux(g.Value), ts))
+		case *ComplexGauge:
+			fields := fmt.Sprintf("count=%di,sum=%s,min=%s,max=%s,sum_squares=%s",
+				g.Count, formatInflux(g.Sum), formatInflux(g.Min), formatInflux(g.Max), formatInflux(g.SumSquares))
+			lines = append(lines, buildInfluxLine(g.Name, sourceOr(g.Source, m.Source), g.Tags, fields, ts))
+		}
+	}
+
+	return
+}
+
+// Builds a single line with tags sorted by key, as influxdb recommends. Tags
+// without a value aren't valid line protocol, so they are left out.
+// "my_key", "app01", {"env": "prod"}, "value=1", 1400000000 =>
+// "my_key,env=prod,source=app01 value=1 1400000000\n"
+func buildInfluxLine(name string, source string, tags map[string]string, fields string, ts int64) string {
+	all := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		if k != "" && v != "" {
+			all[k] = v
+		}
+	}
+	if source != "" {
+		all["source"] = source
+	}
+
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	line := influxMeasurementEscaper.Replace(name)
+	for _, k := range keys {
+		line += "," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(all[k])
+	}
+
+	return fmt.Sprintf("%s %s %d\n", line, fields, ts)
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func formatInflux(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func sourceOr(source string, fallback string) string {
+	if source != "" {
+		return source
+	}
+
+	return fallback
+}
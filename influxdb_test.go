@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildInflux(t *testing.T) {
+	m := &Measurement{
+		Source:   "app01",
+		Counters: []*Counter{{Name: "hits", Value: 40, Tags: map[string]string{"env": "prod"}}},
+		Gauges: []interface{}{
+			&Gauge{Name: "queue depth", Source: "app02", Value: 2.5},
+			&ComplexGauge{Name: "req.95", Count: 2, Sum: 40, Min: 15, Max: 25, SumSquares: 850, Tags: map[string]string{"path": "/a,b", "host": ""}},
+		},
+	}
+
+	got := buildInflux(m, time.Unix(1400000000, 0))
+	expect := []string{
+		"hits,env=prod,source=app01 value=40 1400000000\n",
+		"queue\\ depth,source=app02 value=2.5 1400000000\n",
+		"req.95,path=/a\\,b,source=app01 count=2i,sum=40,min=15,max=25,sum_squares=850 1400000000\n",
+	}
+
+	if strings.Join(got, "") != strings.Join(expect, "") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(got, ""), strings.Join(expect, ""))
+	}
+
+	precision := *influxPrecision
+	defer func() { *influxPrecision = precision }()
+	*influxPrecision = "ms"
+
+	got = buildInflux(&Measurement{Counters: []*Counter{{Name: "hits", Value: 1}}}, time.Unix(1400000000, 0))
+	if got[0] != "hits value=1 1400000000000\n" {
+		t.Errorf("got '%s', expected a timestamp in milliseconds", got[0])
+	}
+}
+
+func TestInfluxBackend(t *testing.T) {
+	var (
+		urls   []string
+		bodies []string
+		auth   string
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		urls = append(urls, r.URL.String())
+		bodies = append(bodies, string(body))
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	bucket, org, token, batch := *influxBucket, *influxOrg, *influxToken, *influxBatch
+	defer func() { *influxBucket, *influxOrg, *influxToken, *influxBatch = bucket, org, token, batch }()
+	*influxBucket, *influxOrg, *influxToken, *influxBatch = "metrics", "ops", "secret", 2
+
+	libratoSource = nil
+	b, err := newInfluxBackend(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Flush(&snapshot{
+		time:     time.Unix(1400000000, 0),
+		counters: map[string]float64{"a": 1, "b": 2},
+		gauges:   map[string]float64{"c": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(urls) != 2 || urls[0] != "/api/v2/write?bucket=metrics&org=ops&precision=s" {
+		t.Errorf("got requests to %+v, expected 2 to the v2 api", urls)
+	}
+
+	if auth != "Token secret" {
+		t.Errorf("got authorization '%s', expected 'Token secret'", auth)
+	}
+
+	lines := strings.Split(strings.Join(bodies, ""), "\n")
+	sort.Strings(lines)
+	if strings.Join(lines, "\n") != "\na value=1 1400000000\nb value=2 1400000000\nc value=3 1400000000" {
+		t.Errorf("unexpected lines: %+v", lines)
+	}
+}
+
+func TestInfluxBackendPending(t *testing.T) {
+	var bodies []string
+	fail := true
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	database, batch := *influxDatabase, *influxBatch
+	defer func() { *influxDatabase, *influxBatch = database, batch }()
+	*influxDatabase, *influxBatch = "metrics", 10
+
+	libratoSource = nil
+	b, err := newInfluxBackend(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Flush(&snapshot{time: time.Unix(1400000000, 0), counters: map[string]float64{"a": 1}}); err == nil {
+		t.Errorf("expected the flush to fail")
+	}
+
+	fail = false
+	if err := b.Flush(&snapshot{time: time.Unix(1400000010, 0), counters: map[string]float64{"a": 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 1 || bodies[0] != "a value=1 1400000000\na value=2 1400000010\n" {
+		t.Errorf("got %q, expected the failed lines to be sent first", bodies)
+	}
+
+	if b.pending != nil {
+		t.Errorf("got %q pending, expected nothing", b.pending)
+	}
+}
+
+func TestNewInfluxBackendErrors(t *testing.T) {
+	database, bucket, precision := *influxDatabase, *influxBucket, *influxPrecision
+	defer func() { *influxDatabase, *influxBucket, *influxPrecision = database, bucket, precision }()
+
+	*influxDatabase, *influxBucket = "", ""
+	if _, err := newInfluxBackend("http://localhost:8086"); err == nil {
+		t.Errorf("expected an error without a database or bucket")
+	}
+
+	*influxDatabase, *influxPrecision = "statsd", "m"
+	if _, err := newInfluxBackend("http://localhost:8086"); err == nil {
+		t.Errorf("expected an error with an unknown precision")
+	}
+
+	*influxPrecision = "s"
+	b, err := newInfluxBackend("http://localhost:8086")
+	if err != nil || b.url != "http://localhost:8086/write?db=statsd&precision=s" {
+		t.Errorf("got %+v (%v), expected the v1 api", b, err)
+	}
+}
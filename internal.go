@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics about the daemon itself. They are kept apart from the metrics it
+// receives, so that they aren't counted as received, and are added to every
+// snapshot that is flushed.
+var internal = newAggregator(aggregatorShards)
+
+// Counts of what every listener receives, which are kept as atomics rather
+// than in internal since they're updated for every message.
+var (
+	packetsReceived atomic.Int64
+	metricsReceived atomic.Int64
+	badLines        atomic.Int64
+)
+
+// Adds to an internal counter, named under statsPrefix. Nothing is recorded
+// without a prefix.
+// "udp.truncated" => "statsd.udp.truncated"
+func countInternal(name string, n float64) {
+	if *statsPrefix != "" {
+		internal.Add(packet{name: *statsPrefix + "." + name, bucket: "c", value: n})
+	}
+}
+
+// Adds a duration to an internal timer, in milliseconds.
+func timeInternal(name string, d time.Duration) {
+	if *statsPrefix != "" {
+		internal.Add(packet{name: *statsPrefix + "." + name, bucket: "ms", value: float64(d) / float64(time.Millisecond)})
+	}
+}
+
+// Sets an internal gauge, named under statsPrefix.
+func gaugeInternal(name string, v float64) {
+	if *statsPrefix != "" {
+		internal.Add(packet{name: *statsPrefix + "." + name, bucket: "g", value: v})
+	}
+}
+
+// Starts a new interval, and returns the metrics received during the last
+// one along with the internal metrics. The packets waiting to be flushed,
+// and the metrics held back behind a slow flush, stand in for the depth of
+// the packets channel the aggregator replaced.
+func takeSnapshot() *snapshot {
+	gaugeInternal("pending_packets", float64(aggregator.Pending()))
+
+	s := aggregator.Snapshot()
+
+	_, _, held := flushes.state()
+	gaugeInternal("flush_held", float64(held))
+
+	countInternal("packets_received", float64(packetsReceived.Swap(0)))
+	countInternal("metrics_received", float64(metricsReceived.Swap(0)))
+	countInternal("bad_lines_seen", float64(badLines.Swap(0)))
+
+	i := internal.Snapshot()
+	for k, v := range i.counters {
+		s.counters[k] += v
+	}
+	for k, v := range i.gauges {
+		s.gauges[k] = v
+	}
+	for k, vs := range i.timers {
+		s.timers[k] = append(s.timers[k], vs...)
+	}
+
+	return s
+}
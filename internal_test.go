@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	aggregator.Snapshot()
+	takeSnapshot()
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = []Backend{&testBackend{name: "a"}, &testBackend{name: "b", err: errors.New("failed")}}
+
+	handle("a:1|c\nbad line\n\nb:2|g:3|g\r\n")
+	handle("c\nd:NaN|g")
+	flush(&snapshot{})
+
+	s := takeSnapshot()
+
+	expect := map[string]float64{
+		"a":                       1,
+		"statsd.packets_received": 2,
+		"statsd.metrics_received": 2,
+		"statsd.bad_lines_seen":   3,
+		"statsd.b.flush_errors":   1,
+	}
+	if !reflect.DeepEqual(s.counters, expect) {
+		t.Errorf("got %+v, expected %+v", s.counters, expect)
+	}
+
+	expect = map[string]float64{"b": 2, "statsd.pending_packets": 2, "statsd.flush_held": 0}
+	if !reflect.DeepEqual(s.gauges, expect) {
+		t.Errorf("got %+v, expected %+v", s.gauges, expect)
+	}
+
+	if len(s.timers["statsd.a.flush_time"]) != 1 || len(s.timers["statsd.b.flush_time"]) != 1 {
+		t.Errorf("got %+v, expected a flush time for each backend", s.timers)
+	}
+
+	if s := takeSnapshot(); s.counters["statsd.packets_received"] != 0 {
+		t.Errorf("got %+v, expected the counts to start over", s.counters)
+	}
+}
+
+func TestInternalPrefix(t *testing.T) {
+	prefix := *statsPrefix
+	defer func() { *statsPrefix = prefix }()
+
+	takeSnapshot()
+
+	*statsPrefix = "app.statsd"
+	handle("a:1|c")
+	if s := takeSnapshot(); s.counters["app.statsd.packets_received"] != 1 {
+		t.Errorf("got %+v, expected counters under the prefix", s.counters)
+	}
+
+	*statsPrefix = ""
+	handle("a:1|c")
+	if s := takeSnapshot(); !reflect.DeepEqual(s.counters, map[string]float64{"a": 1}) {
+		t.Errorf("got %+v, expected no internal metrics without a prefix", s.counters)
+	}
+}
+
+func TestLibratoInternal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	internal.Snapshot()
+
+	if err := postLibrato("/v1/metrics", &Measurement{}); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	s := internal.Snapshot()
+	if s.counters["statsd.librato.status.503"] != 1 || s.counters["statsd.librato.bytes_sent"] == 0 {
+		t.Errorf("got %+v, expected the status and bytes sent to be counted", s.counters)
+	}
+}
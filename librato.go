@@ -2,71 +2,405 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"maps"
 	"math"
 	"net/http"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+var libratoUrl = "https://metrics-api.librato.com"
+
+// The most failed measurements the librato backend holds on to for the next
+// flush when retries are disabled.
+const libratoMaxPending = 10000
+
 type Measurement struct {
-	Counters []*Counter    `json:"counters"`
-	Gauges   []interface{} `json:"gauges"`
-	Source   string        `json:"source,omitempty"`
+	Counters    []*Counter    `json:"counters"`
+	Gauges      []interface{} `json:"gauges"`
+	Source      string        `json:"source,omitempty"`
+	MeasureTime int64         `json:"measure_time,omitempty"`
 }
 
 func (m *Measurement) Count() int {
 	return (len(m.Counters) + len(m.Gauges))
 }
 
+// Splits the measurement into batches of at most size measurements, each
+// with the same source and time. A size of zero or less disables splitting.
+func (m *Measurement) Split(size int) (ms []*Measurement) {
+	if m.Count() == 0 {
+		return
+	}
+
+	if size <= 0 || m.Count() <= size {
+		return []*Measurement{m}
+	}
+
+	b := &Measurement{Source: m.Source, MeasureTime: m.MeasureTime}
+	add := func() {
+		if b.Count() == size {
+			ms = append(ms, b)
+			b = &Measurement{Source: m.Source, MeasureTime: m.MeasureTime}
+		}
+	}
+
+	for _, c := range m.Counters {
+		b.Counters = append(b.Counters, c)
+		add()
+	}
+
+	for _, g := range m.Gauges {
+		b.Gauges = append(b.Gauges, g)
+		add()
+	}
+
+	if b.Count() > 0 {
+		ms = append(ms, b)
+	}
+
+	return
+}
+
+// Folds the tags of every entry into its source, as the source based metrics
+// api has no tags of its own and would otherwise merge series that differ
+// only by their tags. Entries without a source start from the measurement's.
+func (m *Measurement) FoldTags() {
+	fold := func(source *string, tags *map[string]string) {
+		if len(*tags) > 0 {
+			*source, *tags = foldTags(sourceOr(*source, m.Source), *tags), nil
+		}
+	}
+
+	for _, c := range m.Counters {
+		fold(&c.Source, &c.Tags)
+	}
+
+	for _, g := range m.Gauges {
+		switch g := g.(type) {
+		case *Gauge:
+			fold(&g.Source, &g.Tags)
+		case *ComplexGauge:
+			fold(&g.Source, &g.Tags)
+		}
+	}
+}
+
+// Appends tags to a source, sorted by key, in the characters librato allows
+// in a source.
+// "app01", {"role": "web", "env": "prod"} => "app01.env:prod.role:web"
+// "", {"env": "prod"}                     => "env:prod"
+func foldTags(source string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return source
+	}
+
+	ss := make([]string, 0, len(tags)+1)
+	if source != "" {
+		ss = append(ss, source)
+	}
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		ss = append(ss, k+":"+tags[k])
+	}
+
+	return strings.Join(ss, ".")
+}
+
 type Counter struct {
-	Name   string  `json:"name"`
-	Source string  `json:"source,omitempty"`
-	Value  float64 `json:"value"`
+	Name   string            `json:"name"`
+	Source string            `json:"source,omitempty"`
+	Value  float64           `json:"value"`
+	Tags   map[string]string `json:"tags,omitempty"`
 }
 
 type Gauge struct {
-	Name   string  `json:"name"`
-	Source string  `json:"source,omitempty"`
-	Value  float64 `json:"value"`
+	Name   string            `json:"name"`
+	Source string            `json:"source,omitempty"`
+	Value  float64           `json:"value"`
+	Tags   map[string]string `json:"tags,omitempty"`
 }
 
 type ComplexGauge struct {
-	Name       string  `json:"name"`
-	Source     string  `json:"source,omitempty"`
-	Count      int     `json:"count"`
-	Sum        float64 `json:"sum"`
-	Min        float64 `json:"min"`
-	Max        float64 `json:"max"`
-	SumSquares float64 `json:"sum_squares"`
+	Name       string            `json:"name"`
+	Source     string            `json:"source,omitempty"`
+	Count      int               `json:"count"`
+	Sum        float64           `json:"sum"`
+	Min        float64           `json:"min"`
+	Max        float64           `json:"max"`
+	SumSquares float64           `json:"sum_squares"`
+	Tags       map[string]string `json:"tags,omitempty"`
 }
 
-func submitLibrato() (err error) {
-	m := buildMeasurement()
+// A request body for either librato api.
+type payload interface {
+	Count() int
+}
 
-	if m.Count() == 0 {
+// Collects the errors of the batches that failed in a single submission.
+type batchErrors []error
+
+// An unsuccessful response from librato.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// Reports whether a failed submission may succeed if sent again. Requests
+// that librato rejected outright will be rejected again.
+func retryable(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+func (e batchErrors) Error() string {
+	ss := make([]string, len(e))
+	for i, err := range e {
+		ss[i] = err.Error()
+	}
+	return strings.Join(ss, "; ")
+}
+
+// Submits to the librato api selected by libratoApi. The metrics api takes
+// running totals for counters, so the backend keeps them across flushes along
+// with the current value of every gauge. Without a backlog, batches that
+// failed but may succeed later are held and sent with the next flush.
+type libratoBackend struct {
+	status
+	counters    map[string]float64
+	gauges      map[string]float64
+	pending     []payload
+	pendingPath string
+}
+
+func newLibratoBackend() (b *libratoBackend, err error) {
+	if *libratoUser == "" {
+		return nil, fmt.Errorf("specify a librato user with -user or the LIBRATO_USER environment variable")
+	}
+
+	if *libratoToken == "" {
+		return nil, fmt.Errorf("specify a librato token with -token or the LIBRATO_TOKEN environment variable")
+	}
+
+	if *libratoApi != "metrics" && *libratoApi != "measurements" {
+		return nil, fmt.Errorf("unknown librato api %q, expected \"metrics\" or \"measurements\"", *libratoApi)
+	}
+
+	if *spoolDir != "" {
+		if *retrySize <= 0 {
+			return nil, fmt.Errorf("the spool requires retries, specify a -retry-size greater than 0")
+		}
+
+		if err = startSpool(); err != nil {
+			return nil, fmt.Errorf("unable to use spool at %s: %s", *spoolDir, err)
+		}
+	}
+
+	if *retrySize > 0 {
+		log.Printf("retrying up to %d failed measurements for %d seconds\n", *retrySize, *retryAge)
+		go retryLibrato()
+	}
+
+	log.Printf("sending metrics to librato %s api\n", *libratoApi)
+
+	b = &libratoBackend{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+	}
+
+	return
+}
+
+// Deletes running totals of counters and current values of gauges.
+func (b *libratoBackend) delete(bucket string, match func(string) bool) []string {
+	switch bucket {
+	case "c":
+		return deleteKeys(b.counters, match)
+	case "g":
+		return deleteKeys(b.gauges, match)
+	}
+
+	return nil
+}
+
+func (b *libratoBackend) Name() string {
+	return "librato"
+}
+
+func (b *libratoBackend) Flush(s *snapshot) error {
+	return b.record(b.flush(s))
+}
+
+func (b *libratoBackend) flush(s *snapshot) (err error) {
+	for k, v := range s.counters {
+		b.counters[k] += v
+	}
+	applyGauges(b.gauges, s)
+
+	v := &snapshot{counters: s.counters, gauges: b.gauges, timers: s.timers, sets: s.sets}
+
+	var (
+		path    string
+		batches []payload
+	)
+
+	if *libratoApi == "measurements" {
+		path = "/v1/measurements"
+		for _, m := range buildTaggedMeasurement(v).Split(*libratoBatch) {
+			batches = append(batches, m)
+		}
+	} else {
+		v.counters = b.counters
+		path = "/v1/metrics"
+		m := buildMeasurement(v)
+		m.FoldTags()
+		for _, m := range m.Split(*libratoBatch) {
+			batches = append(batches, m)
+		}
+	}
+
+	// Held batches keep the time they were measured at, so they are simply
+	// sent ahead of this flush, unless the api has changed since.
+	if b.pendingPath == path {
+		batches = append(b.pending, batches...)
+	} else {
+		for _, p := range b.pending {
+			dropped(p.Count())
+		}
+	}
+	b.pending = nil
+
+	if len(batches) == 0 {
+		return
+	}
+
+	count, retries, err := postBatches(path, batches)
+
+	if count > 0 {
+		log.Printf("%d measurements sent to librato in %d batches\n", count, len(batches))
+	}
+
+	if *retrySize > 0 {
+		for _, r := range retries {
+			backlog.push(path, r, time.Now())
+		}
 		return
 	}
 
-	payload, err := json.MarshalIndent(m, "", "  ")
+	held := 0
+	for _, r := range retries {
+		held += r.Count()
+	}
+
+	for len(retries) > 0 && held > libratoMaxPending {
+		held -= retries[0].Count()
+		dropped(retries[0].Count())
+		retries = retries[1:]
+	}
+	b.pending, b.pendingPath = retries, path
+
+	return
+}
+
+// Posts batches concurrently, at most libratoConcurrency at a time, and
+// returns the number of measurements that were accepted, the failed batches
+// that are worth retrying and the errors of every batch that failed.
+func postBatches(path string, batches []payload) (count int, retries []payload, err error) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs batchErrors
+		sem  = make(chan struct{}, max(*libratoConcurrency, 1))
+	)
+
+	for i, b := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, b payload) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			e := postLibrato(path, b)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if e != nil {
+				errs = append(errs, fmt.Errorf("batch %d of %d (%d measurements): %s", i+1, len(batches), b.Count(), e))
+				if retryable(e) {
+					retries = append(retries, b)
+				} else {
+					dropped(b.Count())
+				}
+				return
+			}
+			count += b.Count()
+		}(i, b)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		err = errs
+	}
+
+	return
+}
+
+// The settings a request to librato is made with, so that retries can copy
+// them while holding flushMu and make their requests without it.
+type libratoClient struct {
+	user    string
+	token   string
+	timeout time.Duration
+}
+
+// Copies the current settings. The caller must hold flushMu.
+func currentLibrato() libratoClient {
+	return libratoClient{user: *libratoUser, token: *libratoToken, timeout: backendTimeout()}
+}
+
+// Posts with the current settings. The caller must hold flushMu.
+func postLibrato(path string, body interface{}) error {
+	return currentLibrato().post(path, body)
+}
+
+func (c libratoClient) post(path string, body interface{}) (err error) {
+	buf, err := json.MarshalIndent(body, "", "  ")
 	if err != nil {
 		return
 	}
 
 	if *debug {
-		log.Printf("sending payload:\n%s\n", string(payload))
+		log.Printf("sending payload:\n%s\n", string(buf))
 	}
 
-	req, err := http.NewRequest("POST", "https://metrics-api.librato.com/v1/metrics", bytes.NewBuffer(payload))
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", libratoUrl+path, bytes.NewBuffer(buf))
 	if err != nil {
 		return
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "statsd/1.0")
-	req.SetBasicAuth(*libratoUser, *libratoToken)
+	req.SetBasicAuth(c.user, c.token)
 	req.Close = true
 
 	resp, err := http.DefaultClient.Do(req)
@@ -75,47 +409,54 @@ func submitLibrato() (err error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	countInternal("librato.bytes_sent", float64(len(buf)))
+	countInternal(fmt.Sprintf("librato.status.%d", resp.StatusCode), 1)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		raw, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("%s: %s", resp.Status, string(raw))
+		return &statusError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, string(raw))}
 	}
 
-	log.Printf("%d measurements sent to librato\n", m.Count())
-
-	resetTimers()
-
 	return
 }
 
-func buildMeasurement() (m *Measurement) {
+func buildMeasurement(s *snapshot) (m *Measurement) {
 	m = &Measurement{}
+	m.MeasureTime = time.Now().Unix()
 	if libratoSource != nil {
 		m.Source = *libratoSource
 	}
 
-	m.Counters = make([]*Counter, len(counters))
-	m.Gauges = make([]interface{}, len(gauges))
+	m.Counters = make([]*Counter, len(s.counters))
+	m.Gauges = make([]interface{}, len(s.gauges))
 
 	n := 0
-	for k, v := range counters {
+	for k, v := range s.counters {
 		c := &Counter{}
-		c.Name, c.Source = parseSource(k)
+		c.Name, c.Source, c.Tags = parseLibrato(k)
 		c.Value = v
 		m.Counters[n] = c
 		n++
 	}
 
 	n = 0
-	for k, v := range gauges {
+	for k, v := range s.gauges {
 		g := &Gauge{}
-		g.Name, g.Source = parseSource(k)
+		g.Name, g.Source, g.Tags = parseLibrato(k)
 		g.Value = v
 		m.Gauges[n] = g
 		n++
 	}
 
-	for k, t := range timers {
-		for _, pct := range tiles {
+	for k, ms := range s.sets {
+		g := &Gauge{}
+		g.Name, g.Source, g.Tags = parseLibrato(k)
+		g.Value = float64(len(ms))
+		m.Gauges = append(m.Gauges, g)
+	}
+
+	for k, t := range s.timers {
+		for _, pct := range tilesFor(k) {
 			if g := buildComplexGauge(k, t, pct); g != nil {
 				m.Gauges = append(m.Gauges, g)
 			}
@@ -135,18 +476,18 @@ func buildComplexGauge(k string, t []float64, pct float64) *ComplexGauge {
 	}
 
 	g := &ComplexGauge{}
-	g.Name, g.Source = parseSource(k)
+	g.Name, g.Source, g.Tags = parseLibrato(k)
 	if pct != 100.0 {
-		if float64(int(pct)) != pct {
-			rem := int(math.Ceil((pct - float64(int(pct))) * 10))
-			g.Name += fmt.Sprintf(".%d_%d", int(pct), rem)
-		} else {
-			g.Name += fmt.Sprintf(".%d", int(pct))
-		}
+		g.Name += "." + formatPercentile(pct)
 	}
 	g.Count = count
 
-	sort.Float64s(t)
+	// Snapshots hold their timers sorted, and are shared by every backend.
+	if !sort.Float64sAreSorted(t) {
+		t = slices.Clone(t)
+		sort.Float64s(t)
+	}
+
 	g.Min = t[0]
 	g.Max = t[count-1]
 	for i := 0; i < count; i++ {
@@ -156,3 +497,45 @@ func buildComplexGauge(k string, t []float64, pct float64) *ComplexGauge {
 
 	return g
 }
+
+// Formats a percentile for use in a metric name.
+// 95.0 => "95"
+// 99.5 => "99_5"
+func formatPercentile(pct float64) string {
+	if float64(int(pct)) != pct {
+		rem := int(math.Ceil((pct - float64(int(pct))) * 10))
+		return fmt.Sprintf("%d_%d", int(pct), rem)
+	}
+
+	return fmt.Sprintf("%d", int(pct))
+}
+
+// Extracts a key into a name, source and tags, if present.
+// "my_source,my_key|#env:prod,canary" => "my_key", "my_source", {"env": "prod", "canary": "true"}
+func parseLibrato(k string) (name string, source string, tags map[string]string) {
+	name, ts := parseKey(k)
+	name, source = parseSource(name)
+	tags = libratoTagMap(ts)
+	return
+}
+
+// Converts a list of tags to a map, or nil if there are none. Tags without a
+// value are given the value "true".
+// ["env:prod", "canary"] => {"env": "prod", "canary": "true"}
+func libratoTagMap(ts []string) (tags map[string]string) {
+	if len(ts) == 0 {
+		return
+	}
+
+	tags = make(map[string]string, len(ts))
+	for _, t := range ts {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		} else {
+			tags[kv[0]] = "true"
+		}
+	}
+
+	return
+}
@@ -1,26 +1,32 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBuildMeasurements(t *testing.T) {
-	counters = make(map[string]float64)
-	gauges = make(map[string]float64)
-	timers = make(map[string][]float64)
+	agg := newAggregator(4)
 
-	readPacket(packet{name: "a", bucket: "c", value: 15})
-	readPacket(packet{name: "a", bucket: "c", value: 25})
+	agg.Add(packet{name: "a", bucket: "c", value: 15})
+	agg.Add(packet{name: "a", bucket: "c", value: 25})
 
-	readPacket(packet{name: "b", bucket: "g", value: 15.1})
-	readPacket(packet{name: "b", bucket: "g", value: 25.1})
+	agg.Add(packet{name: "b", bucket: "g", value: 15.1})
+	agg.Add(packet{name: "b", bucket: "g", value: 25.1})
 
-	readPacket(packet{name: "c", bucket: "ms", value: 15})
-	readPacket(packet{name: "c", bucket: "ms", value: 25})
+	agg.Add(packet{name: "c", bucket: "ms", value: 15})
+	agg.Add(packet{name: "c", bucket: "ms", value: 25})
 
 	libratoSource = nil
-	m := buildMeasurement()
+	snap := agg.Snapshot()
+	m := buildMeasurement(snap)
 
 	if m.Source != "" {
 		t.Errorf("got '%s', exepcted no source", m.Source)
@@ -45,7 +51,7 @@ func TestBuildMeasurements(t *testing.T) {
 	s := "app01"
 	libratoSource = &s
 
-	m = buildMeasurement()
+	m = buildMeasurement(snap)
 
 	if m.Source != "app01" {
 		t.Errorf("got '%s', exepcted 'app01'", m.Source)
@@ -53,6 +59,86 @@ func TestBuildMeasurements(t *testing.T) {
 
 }
 
+func TestBuildMeasurementsSets(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "app01,users", bucket: "s", member: "1"})
+	agg.Add(packet{name: "app01,users", bucket: "s", member: "2"})
+	agg.Add(packet{name: "app01,users", bucket: "s", member: "2"})
+
+	libratoSource = nil
+	m := buildMeasurement(agg.Snapshot())
+
+	if m.Count() != 1 {
+		t.Errorf("got %d count, expected 1", m.Count())
+	}
+
+	if !reflect.DeepEqual(m.Gauges[0], &Gauge{Name: "users", Source: "app01", Value: 2}) {
+		t.Errorf("unexpected value for gauge 0: %+v", m.Gauges[0])
+	}
+}
+
+func TestBuildMeasurementsTags(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "c", value: 1, tags: []string{"canary", "env:prod"}})
+	agg.Add(packet{name: "b", bucket: "ms", value: 10, tags: []string{"env:prod"}})
+
+	libratoSource = nil
+	m := buildMeasurement(agg.Snapshot())
+
+	if !reflect.DeepEqual(m.Counters[0], &Counter{Name: "a", Value: 1, Tags: map[string]string{"canary": "true", "env": "prod"}}) {
+		t.Errorf("unexpected value for counter 0: %+v", m.Counters[0])
+	}
+
+	if !reflect.DeepEqual(m.Gauges[0], &ComplexGauge{Name: "b", Count: 1, Sum: 10, Min: 10, Max: 10, SumSquares: 100, Tags: map[string]string{"env": "prod"}}) {
+		t.Errorf("unexpected value for gauge 0: %+v", m.Gauges[0])
+	}
+}
+
+func TestMeasurementFoldTags(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "c", value: 1, tags: []string{"env:prod"}})
+	agg.Add(packet{name: "a", bucket: "c", value: 2, tags: []string{"env:dev"}})
+	agg.Add(packet{name: "app01,b", bucket: "g", value: 5, tags: []string{"role:web", "canary"}})
+	agg.Add(packet{name: "c", bucket: "ms", value: 10, tags: []string{"env:prod"}})
+	agg.Add(packet{name: "d", bucket: "c", value: 3})
+
+	s := "default"
+	libratoSource = &s
+	defer func() { libratoSource = nil }()
+
+	m := buildMeasurement(agg.Snapshot())
+	m.FoldTags()
+
+	counters := map[string]float64{}
+	for _, c := range m.Counters {
+		if c.Tags != nil {
+			t.Errorf("got %+v, expected the tags to be folded into the source", c)
+		}
+		counters[c.Name+"@"+c.Source] = c.Value
+	}
+
+	expect := map[string]float64{"a@default.env:prod": 1, "a@default.env:dev": 2, "d@": 3}
+	if !reflect.DeepEqual(counters, expect) {
+		t.Errorf("got %v, expected %v", counters, expect)
+	}
+
+	for _, g := range m.Gauges {
+		switch g := g.(type) {
+		case *Gauge:
+			if g.Source != "app01.canary:true.role:web" || g.Tags != nil {
+				t.Errorf("unexpected value for gauge b: %+v", g)
+			}
+		case *ComplexGauge:
+			if g.Source != "default.env:prod" || g.Tags != nil {
+				t.Errorf("unexpected value for timer c: %+v", g)
+			}
+		}
+	}
+}
+
 func TestComplexGaugeNoData(t *testing.T) {
 	got := buildComplexGauge("name", []float64{}, 100.0)
 	if got != nil {
@@ -235,3 +321,324 @@ func TestComplexGaugeFourPoints99p5th(t *testing.T) {
 		t.Errorf("got '%+v', expected '%+v'", got, expect)
 	}
 }
+
+func TestComplexGaugeUnsorted(t *testing.T) {
+	values := []float64{40, 10, 30, 20}
+	got := buildComplexGauge("name", values, 75)
+
+	if got.Count != 3 || got.Min != 10 || got.Max != 30 {
+		t.Errorf("got '%+v', expected the lowest 3 values", got)
+	}
+
+	if !reflect.DeepEqual(values, []float64{40, 10, 30, 20}) {
+		t.Errorf("got %v, expected the timer values to be left as they were", values)
+	}
+}
+
+func TestMeasurementSplit(t *testing.T) {
+	m := &Measurement{Source: "app01"}
+	for i := 0; i < 3; i++ {
+		m.Counters = append(m.Counters, &Counter{Name: fmt.Sprintf("c%d", i)})
+	}
+	for i := 0; i < 4; i++ {
+		m.Gauges = append(m.Gauges, &Gauge{Name: fmt.Sprintf("g%d", i)})
+	}
+
+	ms := m.Split(3)
+	if len(ms) != 3 {
+		t.Fatalf("got %d batches, expected 3", len(ms))
+	}
+
+	for i, n := range []int{3, 3, 1} {
+		if ms[i].Count() != n {
+			t.Errorf("got %d measurements in batch %d, expected %d", ms[i].Count(), i, n)
+		}
+		if ms[i].Source != "app01" {
+			t.Errorf("got source '%s' in batch %d, expected 'app01'", ms[i].Source, i)
+		}
+	}
+
+	if len(ms[1].Counters) != 0 || len(ms[1].Gauges) != 3 {
+		t.Errorf("got %d counters and %d gauges in batch 1, expected 0 and 3", len(ms[1].Counters), len(ms[1].Gauges))
+	}
+
+	if got := m.Split(0); len(got) != 1 || got[0] != m {
+		t.Errorf("got %d batches with splitting disabled, expected 1", len(got))
+	}
+
+	if got := (&Measurement{}).Split(3); len(got) != 0 {
+		t.Errorf("got %d batches for an empty measurement, expected 0", len(got))
+	}
+}
+
+func TestPostBatches(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := &Measurement{}
+		json.NewDecoder(r.Body).Decode(m)
+
+		if m.Source == "bad" {
+			http.Error(w, "rejected", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		received += m.Count()
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	batches := []payload{
+		&Measurement{Counters: []*Counter{{Name: "a"}, {Name: "b"}}},
+		&Measurement{Counters: []*Counter{{Name: "c"}}, Source: "bad"},
+		&Measurement{Gauges: []interface{}{&Gauge{Name: "d"}}},
+	}
+
+	count, retries, err := postBatches("/v1/metrics", batches)
+
+	if count != 3 || received != 3 {
+		t.Errorf("got %d measurements sent and %d received, expected 3", count, received)
+	}
+
+	errs, ok := err.(batchErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("got error %v, expected one batch error", err)
+	}
+
+	if !strings.HasPrefix(errs[0].Error(), "batch 2 of 3 (1 measurements): 400 Bad Request") {
+		t.Errorf("unexpected batch error: %s", errs[0])
+	}
+
+	if len(retries) != 0 {
+		t.Errorf("got %d batches to retry, expected 0", len(retries))
+	}
+}
+
+func TestPostBatchesRetryable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	batches := []payload{
+		&Measurement{Counters: []*Counter{{Name: "a"}}},
+	}
+
+	count, retries, err := postBatches("/v1/metrics", batches)
+
+	if count != 0 {
+		t.Errorf("got %d measurements sent, expected 0", count)
+	}
+
+	if err == nil {
+		t.Errorf("got no error, expected one")
+	}
+
+	if len(retries) != 1 || retries[0] != batches[0] {
+		t.Errorf("got %+v to retry, expected %+v", retries, batches)
+	}
+}
+
+func TestLibratoBackendFlush(t *testing.T) {
+	var got []*Measurement
+	fail := false
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		m := &Measurement{}
+		json.NewDecoder(r.Body).Decode(m)
+		got = append(got, m)
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	size := *retrySize
+	defer func() { *retrySize = size }()
+	*retrySize = 0
+
+	libratoSource = nil
+	b := &libratoBackend{counters: make(map[string]float64), gauges: make(map[string]float64)}
+
+	b.Flush(&snapshot{
+		counters: map[string]float64{"a": 1},
+		gauges:   map[string]float64{"b": 5},
+		timers:   map[string][]float64{"c": {10}},
+	})
+
+	fail = true
+	if err := b.Flush(&snapshot{counters: map[string]float64{"a": 2}, timers: map[string][]float64{"c": {20}}}); err == nil {
+		t.Errorf("expected the flush to fail")
+	}
+
+	if b.Health() == nil {
+		t.Errorf("expected the backend to be unhealthy")
+	}
+
+	fail = false
+	b.Flush(&snapshot{counters: map[string]float64{"a": 4}, gauges: map[string]float64{"b": 1}, deltas: map[string]bool{"b": true}})
+
+	if b.Health() != nil {
+		t.Errorf("got %s, expected the backend to be healthy", b.Health())
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d submissions, expected 3", len(got))
+	}
+
+	// The held batch and the new one are posted concurrently.
+	held, sent := got[1], got[2]
+	if held.Counters[0].Value != 3 {
+		held, sent = sent, held
+	}
+
+	if held.Counters[0].Value != 3 || len(held.Gauges) != 2 {
+		t.Fatalf("got %+v, expected the batch from the failed flush", held)
+	}
+
+	if g := held.Gauges[1].(map[string]interface{}); g["count"] != 1.0 || g["sum"] != 20.0 {
+		t.Errorf("got %+v for timer c, expected the timer from the failed flush", g)
+	}
+
+	if sent.Counters[0].Value != 7 {
+		t.Errorf("got %f for counter a, expected a running total of 7", sent.Counters[0].Value)
+	}
+
+	if len(sent.Gauges) != 1 {
+		t.Fatalf("got %d gauges, expected 1", len(sent.Gauges))
+	}
+
+	if g := sent.Gauges[0].(map[string]interface{}); g["value"] != 6.0 {
+		t.Errorf("got %+v for gauge b, expected 6", g)
+	}
+
+	if b.pending != nil {
+		t.Errorf("got %+v pending, expected the held batch to be sent", b.pending)
+	}
+}
+
+func TestLibratoBackendFlushDropped(t *testing.T) {
+	var mu sync.Mutex
+	timers := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := &Measurement{}
+		json.NewDecoder(r.Body).Decode(m)
+		switch {
+		case len(m.Counters) > 0 && m.Counters[0].Name == "b":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case len(m.Gauges) > 0:
+			mu.Lock()
+			timers++
+			mu.Unlock()
+			http.Error(w, "invalid", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	size, batch := *retrySize, *libratoBatch
+	defer func() { *retrySize, *libratoBatch = size, batch }()
+	*retrySize, *libratoBatch = 0, 1
+
+	libratoSource = nil
+	b := &libratoBackend{counters: make(map[string]float64), gauges: make(map[string]float64)}
+
+	internal.Snapshot()
+
+	for i := 0; i < 3; i++ {
+		if err := b.Flush(&snapshot{counters: map[string]float64{"a": 1, "b": 2}, timers: map[string][]float64{"c": {10}}}); err == nil {
+			t.Errorf("expected the flush to fail")
+		}
+	}
+
+	// Only the batches that may succeed later are held, one per flush.
+	if len(b.pending) != 3 {
+		t.Errorf("got %d batches pending, expected 3", len(b.pending))
+	}
+
+	for _, p := range b.pending {
+		if m := p.(*Measurement); len(m.Counters) != 1 || m.Counters[0].Name != "b" {
+			t.Errorf("got %+v pending, expected the unavailable batch", m)
+		}
+	}
+
+	if timers != 3 {
+		t.Errorf("got %d timer submissions, expected a rejected batch not to be sent again", timers)
+	}
+
+	if s := internal.Snapshot(); s.counters["statsd.librato.dropped"] != 3 {
+		t.Errorf("got %+v, expected each rejected batch to be counted as dropped", s.counters)
+	}
+}
+
+func TestLibratoBackendFlushMaxPending(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	size, batch := *retrySize, *libratoBatch
+	defer func() { *retrySize, *libratoBatch = size, batch }()
+	*retrySize, *libratoBatch = 0, 0
+
+	libratoSource = nil
+	b := &libratoBackend{counters: make(map[string]float64), gauges: make(map[string]float64)}
+
+	gauges := make(map[string]float64, libratoMaxPending/2)
+	for i := 0; i < libratoMaxPending/2; i++ {
+		gauges[fmt.Sprint(i)] = 1
+	}
+
+	internal.Snapshot()
+
+	for i := 0; i < 3; i++ {
+		b.Flush(&snapshot{gauges: gauges})
+	}
+
+	if len(b.pending) != 2 {
+		t.Errorf("got %d batches pending, expected 2", len(b.pending))
+	}
+
+	if s := internal.Snapshot(); s.counters["statsd.librato.dropped"] != libratoMaxPending/2 {
+		t.Errorf("got %+v, expected the oldest batch to be dropped", s.counters["statsd.librato.dropped"])
+	}
+}
+
+func TestPostLibratoTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	flushed := *interval
+	defer func() { *interval = flushed }()
+	*interval = 1
+
+	start := time.Now()
+	if err := postLibrato("/v1/metrics", &Measurement{}); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("got %v after %s, expected the request to time out after the flush interval", err, time.Since(start))
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A protocol and address to listen for events on.
+// "udp://0.0.0.0:8125"          => udp, 0.0.0.0:8125
+// "http://0.0.0.0:8127"         => http, 0.0.0.0:8127
+// "admin://127.0.0.1:8126"      => admin, 127.0.0.1:8126
+// "unix:///var/run/statsd.sock" => unix, /var/run/statsd.sock
+type listenSpec struct {
+	network string
+	address string
+}
+
+func (l listenSpec) String() string {
+	return l.network + "://" + l.address
+}
+
+// An open listener and the loop that reads events from it.
+type input struct {
+	spec    listenSpec
+	serve   func()
+	closers []io.Closer
+	done    chan struct{}
+}
+
+// Starts reading events in the background.
+func (in *input) start() {
+	in.done = make(chan struct{})
+
+	go func() {
+		defer close(in.done)
+		in.serve()
+	}()
+}
+
+// Reports whether the listener is bound and reading events, which it is from
+// when it's started until it's closed or fails.
+func (in *input) bound() bool {
+	if in.done == nil {
+		return false
+	}
+
+	select {
+	case <-in.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stops the listener and, if it was started, waits for the events it has
+// already received to be handled.
+func (in *input) Close() (err error) {
+	for _, c := range in.closers {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+
+	if in.done != nil {
+		<-in.done
+	}
+
+	return
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Parses a comma separated list of listen specs.
+func parseListenSpecs(s string) (specs []listenSpec, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		network, address, found := strings.Cut(part, "://")
+		if !found || address == "" {
+			return nil, fmt.Errorf("invalid listener %q, expected a protocol and address (eg. \"udp://0.0.0.0:8125\")", part)
+		}
+
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "http", "admin", "health":
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("invalid listener %q: %s", part, err)
+			}
+		case "unix", "unixgram":
+		default:
+			return nil, fmt.Errorf("invalid listener %q, expected a protocol of \"udp\", \"tcp\", \"unix\", \"unixgram\", \"http\", \"admin\" or \"health\"", part)
+		}
+
+		specs = append(specs, listenSpec{network, address})
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no listeners specified")
+	}
+
+	return
+}
+
+// Builds the listen specs when -listen isn't set, from -address, -health and
+// the unix socket paths.
+func defaultListenSpecs(address string, health string, unixgram string, unix string) string {
+	specs := []string{"udp://" + address, "tcp://" + address}
+
+	if health != "" {
+		specs = append(specs, "health://"+health)
+	}
+
+	if unixgram != "" {
+		specs = append(specs, "unixgram://"+unixgram)
+	}
+
+	if unix != "" {
+		specs = append(specs, "unix://"+unix)
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// Opens every listener and starts reading events from it. A listener that
+// can't be opened is reported and skipped, so that the rest still start.
+func startListeners(specs []listenSpec) (inputs []*input) {
+	var states []listenerState
+
+	for _, spec := range specs {
+		in, err := openListener(spec)
+		if err != nil {
+			log.Printf("unable to listen on %s: %s\n", spec, err)
+			states = append(states, listenerState{spec: spec})
+			continue
+		}
+
+		log.Printf("listening for events at %s...\n", in.spec)
+
+		inputs = append(inputs, in)
+		states = append(states, listenerState{spec: in.spec, in: in})
+		in.start()
+	}
+
+	listeners.set(states)
+
+	return
+}
+
+func openListener(spec listenSpec) (in *input, err error) {
+	in = &input{spec: spec}
+
+	switch spec.network {
+	case "udp", "udp4", "udp6":
+		conns, err := openUdp(spec.network, spec.address, *udpReaders)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range conns {
+			in.closers = append(in.closers, c)
+		}
+		in.spec.address = conns[0].LocalAddr().String()
+		in.serve = func() {
+			var wg sync.WaitGroup
+			for _, c := range conns {
+				wg.Add(1)
+				go func(c *net.UDPConn) {
+					defer wg.Done()
+					readUdp(c)
+				}(c)
+			}
+			wg.Wait()
+		}
+
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(spec.network, spec.address)
+		if err != nil {
+			return nil, err
+		}
+
+		in.closers = []io.Closer{l}
+		in.spec.address = l.Addr().String()
+		in.serve = func() { acceptConns(l, handleConn) }
+
+	case "admin":
+		l, err := net.Listen("tcp", spec.address)
+		if err != nil {
+			return nil, err
+		}
+
+		in.closers = []io.Closer{l}
+		in.spec.address = l.Addr().String()
+		in.serve = func() { acceptConns(l, handleAdmin) }
+
+	case "http", "health":
+		l, err := net.Listen("tcp", spec.address)
+		if err != nil {
+			return nil, err
+		}
+
+		server := newHttpServer()
+		if spec.network == "health" {
+			server = newHealthServer()
+		}
+
+		// Shutting down waits for requests in progress to be handled.
+		in.closers = []io.Closer{closerFunc(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+			defer cancel()
+			return server.Shutdown(ctx)
+		})}
+		in.spec.address = l.Addr().String()
+		in.serve = func() {
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				log.Printf("listener at %s stopped: %s\n", in.spec, err)
+			}
+		}
+
+	case "unixgram":
+		conn, err := openUnixgram(spec.address)
+		if err != nil {
+			return nil, err
+		}
+
+		in.closers = []io.Closer{conn}
+		in.serve = func() { readUnixgram(conn) }
+
+	case "unix":
+		l, err := openUnix(spec.address)
+		if err != nil {
+			return nil, err
+		}
+
+		in.closers = []io.Closer{l}
+		in.serve = func() { acceptConns(l, handleConn) }
+
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", spec.network)
+	}
+
+	return
+}
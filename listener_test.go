@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var parseListenSpecsTests = []struct {
+	in     string
+	specs  []listenSpec
+	hasErr bool
+}{
+	{"udp://0.0.0.0:8125", []listenSpec{{"udp", "0.0.0.0:8125"}}, false},
+	{"udp://0.0.0.0:8125, tcp://127.0.0.1:8126", []listenSpec{{"udp", "0.0.0.0:8125"}, {"tcp", "127.0.0.1:8126"}}, false},
+	{"udp6://[::1]:8125,unix:///var/run/statsd.sock", []listenSpec{{"udp6", "[::1]:8125"}, {"unix", "/var/run/statsd.sock"}}, false},
+	{"unixgram:///tmp/s.sock", []listenSpec{{"unixgram", "/tmp/s.sock"}}, false},
+	{"0.0.0.0:8125", nil, true},
+	{"http://0.0.0.0:8127", []listenSpec{{"http", "0.0.0.0:8127"}}, false},
+	{"admin://127.0.0.1:8126", []listenSpec{{"admin", "127.0.0.1:8126"}}, false},
+	{"health://0.0.0.0:8128", []listenSpec{{"health", "0.0.0.0:8128"}}, false},
+	{"ftp://0.0.0.0:8125", nil, true},
+	{"tcp://localhost", nil, true},
+	{"udp://", nil, true},
+	{"", nil, true},
+}
+
+func TestParseListenSpecs(t *testing.T) {
+	for _, s := range parseListenSpecsTests {
+		specs, err := parseListenSpecs(s.in)
+		if (err != nil) != s.hasErr || !reflect.DeepEqual(specs, s.specs) {
+			t.Errorf("%q: got %+v (%v), expected %+v", s.in, specs, err, s.specs)
+		}
+	}
+}
+
+func TestDefaultListenSpecs(t *testing.T) {
+	if s := defaultListenSpecs("0.0.0.0:8125", "", "", "/tmp/s.sock"); s != "udp://0.0.0.0:8125,tcp://0.0.0.0:8125,unix:///tmp/s.sock" {
+		t.Errorf("got '%s'", s)
+	}
+
+	if s := defaultListenSpecs("0.0.0.0:8125", "0.0.0.0:8128", "", ""); s != "udp://0.0.0.0:8125,tcp://0.0.0.0:8125,health://0.0.0.0:8128" {
+		t.Errorf("got '%s'", s)
+	}
+}
+
+func TestStartListeners(t *testing.T) {
+	aggregator.Snapshot()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	inputs := startListeners([]listenSpec{
+		{"udp", "127.0.0.1:0"},
+		{"tcp", taken.Addr().String()},
+		{"tcp", "127.0.0.1:0"},
+		{"unixgram", path},
+	})
+	defer func() {
+		for _, in := range inputs {
+			in.Close()
+		}
+	}()
+
+	// The tcp listener on a port that's in use fails without stopping the rest.
+	if len(inputs) != 3 {
+		t.Fatalf("got %d listeners, expected 3", len(inputs))
+	}
+
+	for i, in := range inputs {
+		conn, err := net.Dial(in.spec.network, in.spec.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(string(rune('a'+i)) + ":1|c\n"))
+		conn.Close()
+	}
+
+	waitPending(3)
+
+	if s := aggregator.Snapshot(); !reflect.DeepEqual(s.counters, map[string]float64{"a": 1, "b": 1, "c": 1}) {
+		t.Errorf("got %+v, expected a packet from each listener", s.counters)
+	}
+}
@@ -3,48 +3,169 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
 const VERSION = "1.0.0"
 
 var (
-	address       = flag.String("address", "0.0.0.0:8125", "udp listen address")
-	libratoUser   = flag.String("user", "", "librato api username (LIBRATO_USER)")
-	libratoToken  = flag.String("token", "", "librato api token (LIBRATO_TOKEN)")
-	libratoSource = flag.String("source", "", "librato api source (LIBRATO_SOURCE)")
-	interval      = flag.Int64("flush", 60, "interval at which data is sent to librato (in seconds)")
-	percentiles   = flag.String("percentiles", "", "comma separated list of percentiles to calculate for timers (eg. \"95,99.5\")")
-	proxy         = flag.String("proxy", "", "send metrics to a proxy rather than directly to librato")
-	debug         = flag.Bool("debug", false, "enable logging of inputs and submissions")
-	version       = flag.Bool("version", false, "print version and exit")
+	configPath            = flag.String("config", "", "path of a toml config file, settings given as flags or environment variables take precedence (CONFIG)")
+	checkConfig           = flag.Bool("check-config", false, "validate the configuration and exit")
+	address               = flag.String("address", "0.0.0.0:8125", "udp and tcp listen address, when -listen isn't set")
+	listen                = flag.String("listen", "", "comma separated list of udp, tcp, unix, unixgram, http, admin and health listeners, replacing -address, -health, -unix and -unixgram (eg. \"udp://0.0.0.0:8125,tcp://127.0.0.1:8126\") (LISTEN)")
+	health                = flag.String("health", "", "listen address of the /health and /ready endpoints, when -listen isn't set (eg. \"127.0.0.1:8128\")")
+	udpMaxSize            = flag.Int("udp-max-size", 65535, "maximum size of a udp or unix datagram, larger datagrams are truncated (in bytes)")
+	udpReadBuffer         = flag.Int("udp-rcvbuf", 0, "size of the udp socket receive buffer (in bytes, 0 uses the system default)")
+	udpReaders            = flag.Int("udp-readers", 1, "number of udp sockets to read from in parallel, using SO_REUSEPORT when more than 1")
+	tcpMaxLine            = flag.Int("tcp-max-line", 65536, "maximum length of a line received over tcp or a unix stream (in bytes)")
+	tcpTimeout            = flag.Int64("tcp-timeout", 300, "close tcp and unix stream connections that are idle for this long (in seconds, 0 disables)")
+	tcpMaxConns           = flag.Int("tcp-max-conns", 1024, "maximum number of concurrent tcp and unix stream connections")
+	httpMaxSize           = flag.Int64("http-max-size", 1048576, "maximum size of a request body received over http (in bytes)")
+	httpToken             = flag.String("http-token", "", "bearer token required by http listeners (HTTP_TOKEN)")
+	readyMaxFailing       = flag.Int64("ready-max-failing", 300, "report not ready on /ready once flushes to a backend have been failing for this long (in seconds, 0 disables)")
+	unixgram              = flag.String("unixgram", "", "path of a unix datagram socket to listen on, when -listen isn't set")
+	unixStream            = flag.String("unix", "", "path of a unix stream socket to listen on, when -listen isn't set")
+	unixMode              = flag.String("unix-mode", "0660", "permissions of the unix socket files")
+	unixOwner             = flag.String("unix-owner", "", "owner and group of the unix socket files (eg. \"statsd:adm\")")
+	libratoUser           = flag.String("user", "", "librato api username (LIBRATO_USER)")
+	libratoToken          = flag.String("token", "", "librato api token (LIBRATO_TOKEN)")
+	libratoSource         = flag.String("source", "", "librato api source (LIBRATO_SOURCE)")
+	libratoApi            = flag.String("api", "", "librato api to submit to, \"metrics\" (source based, default) or \"measurements\" (tagged) (LIBRATO_API)")
+	libratoTags           = flag.String("tags", "", "comma separated list of default tags for the measurements api (eg. \"env:prod,region:us-east\") (LIBRATO_TAGS)")
+	libratoBatch          = flag.Int("batch", 300, "maximum number of measurements per librato request")
+	libratoConcurrency    = flag.Int("concurrency", 4, "maximum number of concurrent librato requests")
+	retrySize             = flag.Int("retry-size", 10000, "maximum number of failed measurements held for retry (0 disables retries)")
+	retryAge              = flag.Int64("retry-age", 1800, "maximum age of failed measurements held for retry (in seconds)")
+	spoolDir              = flag.String("spool", "", "directory in which to keep failed measurements across restarts (SPOOL)")
+	spoolSize             = flag.Int64("spool-size", 64, "maximum size of the spool directory (in megabytes)")
+	statsPrefix           = flag.String("stats-prefix", "statsd", "prefix for the metrics about the daemon itself, such as statsd.packets_received (empty disables them)")
+	shutdownTimeout       = flag.Int64("shutdown-timeout", 10, "time allowed for the final flush when shutting down (in seconds)")
+	interval              = flag.Int64("flush", 60, "interval at which data is sent to librato (in seconds)")
+	percentiles           = flag.String("percentiles", "", "comma separated list of percentiles to calculate for timers (eg. \"95,99.5\")")
+	proxy                 = flag.String("proxy", "", "address of a statsd to forward metrics to with the proxy backend (PROXY)")
+	backendNames          = flag.String("backends", "", "comma separated list of backends to flush to, \"librato\", \"proxy\", \"graphite\", \"prometheus\" and \"influxdb\" (default \"proxy\" if -proxy is set, otherwise \"librato\") (BACKENDS)")
+	prometheus            = flag.String("prometheus", "", "listen address for the prometheus backend's /metrics endpoint (eg. \":9102\") (PROMETHEUS)")
+	influxdb              = flag.String("influxdb", "", "url of an influxdb server for the influxdb backend (eg. \"http://localhost:8086\") (INFLUXDB)")
+	influxDatabase        = flag.String("influxdb-database", "", "influxdb database to write to with the v1 api")
+	influxBucket          = flag.String("influxdb-bucket", "", "influxdb bucket to write to with the v2 api")
+	influxOrg             = flag.String("influxdb-org", "", "influxdb organization that owns the bucket")
+	influxToken           = flag.String("influxdb-token", "", "influxdb api token (INFLUXDB_TOKEN)")
+	influxPrecision       = flag.String("influxdb-precision", "s", "precision of influxdb timestamps, \"s\", \"ms\", \"us\" or \"ns\"")
+	influxBatch           = flag.Int("influxdb-batch", 5000, "maximum number of lines per influxdb request")
+	graphite              = flag.String("graphite", "", "address of a carbon plaintext listener for the graphite backend (GRAPHITE)")
+	graphitePrefix        = flag.String("graphite-prefix", "stats", "prefix for every graphite metric")
+	graphiteCounterPrefix = flag.String("graphite-counter-prefix", "counters", "prefix for graphite counters")
+	graphiteTimerPrefix   = flag.String("graphite-timer-prefix", "timers", "prefix for graphite timers")
+	graphiteGaugePrefix   = flag.String("graphite-gauge-prefix", "gauges", "prefix for graphite gauges")
+	graphiteSetPrefix     = flag.String("graphite-set-prefix", "sets", "prefix for graphite sets")
+	debug                 = flag.Bool("debug", false, "enable logging of inputs and submissions")
+	version               = flag.Bool("version", false, "print version and exit")
 )
 
-func monitor() {
-	var err error
-
+// Flushes at every interval, and reloads the configuration on SIGHUP, until
+// another signal is received. A reload waits for the running flush to
+// finish, so it happens in the background while flushes and signals are
+// still handled here.
+func monitor(signals <-chan os.Signal) os.Signal {
 	t := time.NewTicker(time.Duration(*interval) * time.Second)
+	defer t.Stop()
+
+	reloading := false
+	reloaded := make(chan []change, 1)
 
 	for {
 		select {
 		case <-t.C:
-			if *proxy != "" {
-				if err = submitProxy(); err != nil {
-					log.Printf("unable to submit to proxy at %s: %s\n", *proxy, err)
-				}
-			} else {
-				if err := submitLibrato(); err != nil {
-					log.Printf("unable to submit measurements: %s\n", err)
+			flushes.push(takeSnapshot())
+
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				return sig
+			}
+
+			if reloading {
+				log.Printf("configuration reload already in progress, ignoring %s\n", sig)
+				continue
+			}
+
+			reloading = true
+			go func() { reloaded <- reloadConfig() }()
+
+		case changes := <-reloaded:
+			reloading = false
+			for _, c := range changes {
+				if c.name == "flush" {
+					flush, _ := strconv.ParseInt(c.to, 10, 64)
+					t.Reset(time.Duration(flush) * time.Second)
 				}
 			}
+		}
+	}
+}
+
+// Stops the listeners, handles the events they have already received and
+// flushes everything that hasn't been sent. Returns the exit status, which
+// is 1 if the final flush failed or didn't finish within shutdownTimeout, or
+// a signal other than SIGHUP is received while waiting.
+func shutdown(inputs []*input, signals <-chan os.Signal) int {
+	for _, in := range inputs {
+		if err := in.Close(); err != nil {
+			log.Printf("unable to close listener at %s: %s\n", in.spec, err)
+		}
+	}
+
+	// Backends that serve requests of their own, such as prometheus, stop
+	// along with the listeners.
+	for _, b := range backends {
+		if c, ok := b.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("unable to close %s backend: %s\n", b.Name(), err)
+			}
+		}
+	}
+
+	flushes.push(takeSnapshot())
+
+	done := make(chan struct{})
+	go func() {
+		flushes.wait()
+		close(done)
+	}()
+
+	timeout := time.After(time.Duration(*shutdownTimeout) * time.Second)
+
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-timeout:
+			log.Printf("final flush didn't finish within %d seconds\n", *shutdownTimeout)
+			return 1
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				continue
+			}
+			log.Printf("received %s during the final flush, exiting\n", sig)
+			return 1
+		}
+	}
 
-		case p := <-packets:
-			readPacket(p)
+	status := 0
+	for _, b := range backends {
+		if err := b.Health(); err != nil {
+			log.Printf("final flush to %s failed: %s\n", b.Name(), err)
+			status = 1
 		}
 	}
+
+	return status
 }
 
 func main() {
@@ -55,51 +176,53 @@ func main() {
 		return
 	}
 
-	if *proxy == "" {
-		getEnv(proxy, "PROXY")
+	err := loadConfig()
+	if err == nil {
+		err = validateConfig()
 	}
 
-	if *proxy != "" {
-		log.Printf("sending metrics to proxy at %s\n", *proxy)
-	} else {
-		if *libratoUser == "" {
-			if !getEnv(libratoUser, "LIBRATO_USER") {
-				log.Fatal("specify a librato user with -user or the LIBRATO_USER environment variable")
-			}
-		}
-
-		if *libratoToken == "" {
-			if !getEnv(libratoToken, "LIBRATO_TOKEN") {
-				log.Fatal("specify a librato token with -token or the LIBRATO_TOKEN environment variable")
-			}
+	if err != nil {
+		if *checkConfig {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+			os.Exit(1)
 		}
+		log.Fatalf("invalid configuration:\n%s\n", err)
+	}
 
-		if *libratoSource == "" {
-			getEnv(libratoSource, "LIBRATO_SOURCE")
-		}
+	if *checkConfig {
+		fmt.Println("configuration ok")
+		return
+	}
 
-		if *percentiles == "" {
-			getEnv(percentiles, "PERCENTILES")
-		}
+	tiles = buildTiles(*percentiles)
+	storeAdminSettings()
+	for _, f := range tiles[1:] {
+		log.Printf("including percentile %f for timers\n", f)
+	}
 
-		if *percentiles != "" {
-			for _, s := range strings.Split(*percentiles, ",") {
-				if f := parseFloat(s); f > 0.0 && f < 100.0 {
-					tiles = append(tiles, f)
-					log.Printf("including percentile %f for timers\n", f)
-				}
-			}
-		}
+	specs, err := parseListenSpecs(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		log.Printf("sending metrics to librato\n")
+	if backends, err = newBackends(*backendNames); err != nil {
+		log.Fatal(err)
 	}
 
 	log.Printf("flushing metrics every %d seconds\n", *interval)
 
-	go listenUdp()
-	go listenTcp()
+	inputs := startListeners(specs)
+	if len(inputs) == 0 {
+		log.Fatal("unable to start any listeners")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	sig := monitor(signals)
+	log.Printf("received %s, shutting down\n", sig)
 
-	monitor()
+	os.Exit(shutdown(inputs, signals))
 }
 
 func getEnv(p *string, key string) bool {
@@ -1,9 +1,123 @@
 package main
 
 import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestBuilds(t *testing.T) {
 	return
 }
+
+func TestShutdown(t *testing.T) {
+	aggregator.Snapshot()
+
+	b := &testBackend{name: "b"}
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = []Backend{b}
+
+	inputs := startListeners([]listenSpec{{"tcp", "127.0.0.1:0"}})
+	if len(inputs) != 1 {
+		t.Fatalf("got %d listeners, expected 1", len(inputs))
+	}
+
+	// The connection is left open, and closed by the shutdown.
+	conn, err := net.Dial("tcp", inputs[0].spec.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("a:1|c\n"))
+	waitPending(1)
+
+	if status := shutdown(inputs, nil); status != 0 {
+		t.Errorf("got status %d, expected 0", status)
+	}
+
+	if b.flushes != 1 || b.snapshots[0].counters["a"] != 1 {
+		t.Errorf("got %d flushes of %+v, expected a final flush of counter a", b.flushes, b.snapshots)
+	}
+
+	if _, err := net.Dial("tcp", inputs[0].spec.address); err == nil {
+		t.Errorf("expected the listener to be closed")
+	}
+}
+
+func TestShutdownFailures(t *testing.T) {
+	timeout := *shutdownTimeout
+	saved := backends
+	defer func() { *shutdownTimeout, backends = timeout, saved }()
+
+	backends = []Backend{&testBackend{name: "a"}, &testBackend{name: "b", err: errors.New("failed")}}
+
+	if status := shutdown(nil, nil); status != 1 {
+		t.Errorf("got status %d, expected 1 when a backend fails", status)
+	}
+
+	b := &testBackend{name: "b", block: make(chan struct{})}
+	backends = []Backend{b}
+	*shutdownTimeout = 1
+
+	if status := shutdown(nil, nil); status != 1 {
+		t.Errorf("got status %d, expected 1 when the flush times out", status)
+	}
+
+	close(b.block)
+	flushes.wait()
+}
+
+func TestMonitorReload(t *testing.T) {
+	defer saveFlags()()
+
+	saved := backends
+	defer func() { backends = saved }()
+	backends = nil
+
+	path := writeConfig(t, "backends = [\"proxy\"]\nproxy.address = \"127.0.0.1:8125\"\nflush = 60\n")
+	t.Setenv("CONFIG", path)
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("backends = [\"proxy\"]\nproxy.address = \"127.0.0.1:8125\"\nflush = 30\n"), 0644)
+
+	// A flush that hangs holds up the reload, but not the signals.
+	flushMu.RLock()
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan os.Signal)
+	go func() { done <- monitor(signals) }()
+
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGTERM
+
+	select {
+	case sig := <-done:
+		if sig != syscall.SIGTERM {
+			t.Errorf("got %s, expected SIGTERM", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the monitor to return while the reload waits")
+	}
+
+	flushMu.RUnlock()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		flushMu.RLock()
+		flush := *interval
+		flushMu.RUnlock()
+
+		if flush == 30 {
+			return
+		}
+	}
+
+	t.Errorf("expected the reload to finish once the flush did")
+}
@@ -1,41 +1,334 @@
 package main
 
+import (
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
 var (
-	counters = make(map[string]float64)
-	gauges   = make(map[string]float64)
-	timers   = make(map[string][]float64)
-	tiles    = make([]float64, 0)
+	aggregator = newAggregator(aggregatorShards)
+	tiles      = make([]float64, 0)
 )
 
 func init() {
 	tiles = append(tiles, 100.0)
 }
 
-func readPacket(p packet) {
+// Builds the percentiles calculated for timers from a comma separated list,
+// after the 100th which is always included.
+// "95,99.5" => [100 95 99.5]
+func buildTiles(s string) []float64 {
+	ts := []float64{100.0}
+
+	if s != "" {
+		for _, p := range strings.Split(s, ",") {
+			if f := parseFloat(strings.TrimSpace(p)); f > 0.0 && f < 100.0 {
+				ts = append(ts, f)
+			}
+		}
+	}
+
+	return ts
+}
+
+const aggregatorShards = 16
+
+// Aggregates packets into the metrics for the current interval. Keys are
+// spread across shards, each with its own lock, so that packets can be added
+// from every listener at once without waiting on each other or on a flush.
+type Aggregator struct {
+	shards []*shard
+}
+
+// The metrics for the keys that hash to a single shard.
+type shard struct {
+	mu       sync.Mutex
+	count    int
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string][]float64
+	sets     map[string]map[string]struct{}
+	deltas   map[string]bool
+	last     time.Time
+}
+
+func newAggregator(n int) *Aggregator {
+	a := &Aggregator{shards: make([]*shard, max(n, 1))}
+	for i := range a.shards {
+		a.shards[i] = &shard{}
+		a.shards[i].reset()
+	}
+
+	return a
+}
+
+func (a *Aggregator) shard(k string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return a.shards[h.Sum32()%uint32(len(a.shards))]
+}
+
+func (a *Aggregator) Add(p packet) {
+	k := p.key()
+	sh := a.shard(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.count++
+	sh.last = time.Now()
+
 	switch p.bucket {
 	case "c":
-		if _, f := counters[p.name]; !f {
-			counters[p.name] = 0.0
-		}
-		counters[p.name] += p.value
+		sh.counters[k] += p.value
 
 	case "g":
-		gauges[p.name] = p.value
+		if p.relative {
+			if _, f := sh.gauges[k]; !f {
+				sh.deltas[k] = true
+			}
+			sh.gauges[k] += p.value
+		} else {
+			sh.gauges[k] = p.value
+			delete(sh.deltas, k)
+		}
 
 	case "ms":
-		if _, f := timers[p.name]; !f {
-			timers[p.name] = make([]float64, 0)
+		sh.timers[k] = append(sh.timers[k], p.value)
+
+	case "s":
+		if _, f := sh.sets[k]; !f {
+			sh.sets[k] = make(map[string]struct{})
+		}
+		sh.sets[k][p.member] = struct{}{}
+	}
+}
+
+// Returns the number of packets added since the last snapshot.
+func (a *Aggregator) Pending() (n int) {
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+		n += sh.count
+		sh.mu.Unlock()
+	}
+
+	return
+}
+
+// Returns the metrics aggregated since the last snapshot and starts a new
+// interval. Every shard is locked while they are swapped out, so a packet is
+// either in this snapshot or the next.
+func (a *Aggregator) Snapshot() (s *snapshot) {
+	s = &snapshot{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string][]float64),
+		sets:     make(map[string]map[string]struct{}),
+		deltas:   make(map[string]bool),
+	}
+
+	taken := make([]*snapshot, len(a.shards))
+
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+	}
+
+	s.time = time.Now()
+
+	for i, sh := range a.shards {
+		taken[i] = &snapshot{counters: sh.counters, gauges: sh.gauges, timers: sh.timers, sets: sh.sets, deltas: sh.deltas}
+		sh.reset()
+		sh.mu.Unlock()
+	}
+
+	// Each key belongs to a single shard, so the shards can be combined
+	// without merging values.
+	for _, t := range taken {
+		maps.Copy(s.counters, t.counters)
+		maps.Copy(s.gauges, t.gauges)
+		maps.Copy(s.timers, t.timers)
+		maps.Copy(s.sets, t.sets)
+		maps.Copy(s.deltas, t.deltas)
+	}
+
+	for _, vs := range s.timers {
+		sort.Float64s(vs)
+	}
+
+	return
+}
+
+// Returns a copy of the metrics aggregated since the last snapshot, without
+// starting a new interval.
+func (a *Aggregator) Peek() (s *snapshot) {
+	s = &snapshot{
+		time:     time.Now(),
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string][]float64),
+		sets:     make(map[string]map[string]struct{}),
+		deltas:   make(map[string]bool),
+	}
+
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+		maps.Copy(s.counters, sh.counters)
+		maps.Copy(s.gauges, sh.gauges)
+		maps.Copy(s.deltas, sh.deltas)
+		for k, vs := range sh.timers {
+			s.timers[k] = slices.Clone(vs)
+		}
+		for k, ms := range sh.sets {
+			s.sets[k] = maps.Clone(ms)
+		}
+		sh.mu.Unlock()
+	}
+
+	return
+}
+
+// Removes the metrics of a bucket whose keys match from the current
+// interval, and returns their keys.
+func (a *Aggregator) Delete(bucket string, match func(string) bool) (keys []string) {
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+
+		switch bucket {
+		case "c":
+			keys = append(keys, deleteKeys(sh.counters, match)...)
+		case "g":
+			keys = append(keys, deleteKeys(sh.gauges, match)...)
+			deleteKeys(sh.deltas, match)
+		case "ms":
+			keys = append(keys, deleteKeys(sh.timers, match)...)
+		case "s":
+			keys = append(keys, deleteKeys(sh.sets, match)...)
 		}
-		timers[p.name] = append(timers[p.name], p.value)
+
+		sh.mu.Unlock()
 	}
+
+	return
+}
+
+// Returns when the most recent packet was added, or the zero time if none
+// have been.
+func (a *Aggregator) LastAdded() (t time.Time) {
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+		if sh.last.After(t) {
+			t = sh.last
+		}
+		sh.mu.Unlock()
+	}
+
+	return
+}
+
+// Removes the keys that match from a map, and returns them.
+func deleteKeys[V any](m map[string]V, match func(string) bool) (keys []string) {
+	for k := range m {
+		if match(k) {
+			delete(m, k)
+			keys = append(keys, k)
+		}
+	}
+
+	return
+}
+
+func (sh *shard) reset() {
+	sh.count = 0
+	sh.counters = make(map[string]float64)
+	sh.gauges = make(map[string]float64)
+	sh.timers = make(map[string][]float64)
+	sh.sets = make(map[string]map[string]struct{})
+	sh.deltas = make(map[string]bool)
+}
+
+// The metrics aggregated over a single flush interval, ending at time.
+// Gauges hold the value set during the interval, or the net adjustment for
+// gauges in deltas that only received relative updates. Snapshots that are
+// taken or merged hold their timer values sorted.
+type snapshot struct {
+	time     time.Time
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string][]float64
+	sets     map[string]map[string]struct{}
+	deltas   map[string]bool
 }
 
-func resetTimers() {
-	timers = make(map[string][]float64)
+func (s *snapshot) Count() int {
+	return len(s.counters) + len(s.gauges) + len(s.timers) + len(s.sets)
 }
 
-func resetAll() {
-	counters = make(map[string]float64)
-	gauges = make(map[string]float64)
-	timers = make(map[string][]float64)
+// Combines an earlier snapshot with a later one as if they had been a single
+// interval, without modifying either.
+func mergeSnapshots(a *snapshot, b *snapshot) (s *snapshot) {
+	s = &snapshot{
+		time:     b.time,
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string][]float64),
+		sets:     make(map[string]map[string]struct{}),
+		deltas:   make(map[string]bool),
+	}
+
+	for _, x := range []*snapshot{a, b} {
+		for k, v := range x.counters {
+			s.counters[k] += v
+		}
+
+		for k, v := range x.gauges {
+			if _, f := s.gauges[k]; f && x.deltas[k] {
+				s.gauges[k] += v
+				continue
+			}
+			s.gauges[k] = v
+			s.deltas[k] = x.deltas[k]
+		}
+
+		for k, vs := range x.timers {
+			s.timers[k] = append(s.timers[k], vs...)
+		}
+
+		for k, ms := range x.sets {
+			if _, f := s.sets[k]; !f {
+				s.sets[k] = make(map[string]struct{})
+			}
+			for m := range ms {
+				s.sets[k][m] = struct{}{}
+			}
+		}
+	}
+
+	for k, d := range s.deltas {
+		if !d {
+			delete(s.deltas, k)
+		}
+	}
+
+	for _, vs := range s.timers {
+		sort.Float64s(vs)
+	}
+
+	return
+}
+
+// Updates a set of current gauge values with the gauges from a snapshot,
+// applying relative updates to the existing value.
+func applyGauges(dst map[string]float64, s *snapshot) {
+	for k, v := range s.gauges {
+		if s.deltas[k] {
+			dst[k] += v
+		} else {
+			dst[k] = v
+		}
+	}
 }
@@ -1,60 +1,251 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 )
 
 func TestReadPackets(t *testing.T) {
-	counters = make(map[string]float64)
-	gauges = make(map[string]float64)
-	timers = make(map[string][]float64)
+	agg := newAggregator(4)
 
-	readPacket(packet{name: "a", bucket: "c", value: 15})
-	readPacket(packet{name: "a", bucket: "c", value: 25})
-	readPacket(packet{name: "b", bucket: "c", value: 90})
+	agg.Add(packet{name: "a", bucket: "c", value: 15})
+	agg.Add(packet{name: "a", bucket: "c", value: 25})
+	agg.Add(packet{name: "b", bucket: "c", value: 90})
 
-	if len(counters) != 2 {
-		t.Errorf("got %d counters, expected 2", len(counters))
+	agg.Add(packet{name: "a", bucket: "g", value: 15.1})
+	agg.Add(packet{name: "a", bucket: "g", value: 25.1})
+	agg.Add(packet{name: "b", bucket: "g", value: 90.1})
+
+	agg.Add(packet{name: "c", bucket: "ms", value: 25.3})
+	agg.Add(packet{name: "c", bucket: "ms", value: 15.3})
+	agg.Add(packet{name: "d", bucket: "ms", value: 90.3})
+
+	if agg.Pending() != 9 {
+		t.Errorf("got %d pending packets, expected 9", agg.Pending())
+	}
+
+	s := agg.Snapshot()
+
+	if len(s.counters) != 2 {
+		t.Errorf("got %d counters, expected 2", len(s.counters))
+	}
+
+	if s.counters["a"] != 40 {
+		t.Errorf("got %f for counter a, expected 40", s.counters["a"])
+	}
+
+	if s.counters["b"] != 90 {
+		t.Errorf("got %f for counter b, expected 90", s.counters["b"])
+	}
+
+	if len(s.gauges) != 2 {
+		t.Errorf("got %d gauges, expected 2", len(s.gauges))
+	}
+
+	if s.gauges["a"] != 25.1 {
+		t.Errorf("got %f for gauge a, expected 25.1", s.gauges["a"])
+	}
+
+	if s.gauges["b"] != 90.1 {
+		t.Errorf("got %f for gauge b, expected 90.1", s.gauges["b"])
+	}
+
+	if len(s.timers) != 2 {
+		t.Errorf("got %d timers, expected 2", len(s.timers))
+	}
+
+	if !reflect.DeepEqual(s.timers["c"], []float64{15.3, 25.3}) {
+		t.Errorf("got %+v for timer c, expected {15.3, 25.3} sorted", s.timers["c"])
+	}
+
+	if !reflect.DeepEqual(s.timers["d"], []float64{90.3}) {
+		t.Errorf("got %+v for timer d, expected {90.3}", s.timers["d"])
+	}
+
+	if s = agg.Snapshot(); s.Count() != 0 || agg.Pending() != 0 {
+		t.Errorf("got %d metrics and %d pending packets after a snapshot, expected 0", s.Count(), agg.Pending())
 	}
+}
+
+func TestReadSetPackets(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "s", member: "1"})
+	agg.Add(packet{name: "a", bucket: "s", member: "2"})
+	agg.Add(packet{name: "a", bucket: "s", member: "1"})
+	agg.Add(packet{name: "b", bucket: "s", member: "x"})
+
+	s := agg.Snapshot()
 
-	if counters["a"] != 40 {
-		t.Errorf("got %d for counter a, expected 40", counters["a"])
+	if len(s.sets) != 2 {
+		t.Errorf("got %d sets, expected 2", len(s.sets))
 	}
 
-	if counters["b"] != 90 {
-		t.Errorf("got %d for counter b, expected 90", counters["b"])
+	if len(s.sets["a"]) != 2 {
+		t.Errorf("got %d members for set a, expected 2", len(s.sets["a"]))
 	}
 
-	readPacket(packet{name: "a", bucket: "g", value: 15.1})
-	readPacket(packet{name: "a", bucket: "g", value: 25.1})
-	readPacket(packet{name: "b", bucket: "g", value: 90.1})
+	if len(s.sets["b"]) != 1 {
+		t.Errorf("got %d members for set b, expected 1", len(s.sets["b"]))
+	}
 
-	if len(gauges) != 2 {
-		t.Errorf("got %d gauges, expected 2", len(gauges))
+	if s = agg.Snapshot(); len(s.sets) != 0 {
+		t.Errorf("got %d sets after snapshot, expected 0", len(s.sets))
 	}
+}
+
+func TestReadRelativeGauges(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "g", value: 10})
+	agg.Add(packet{name: "a", bucket: "g", value: 5, relative: true})
+	agg.Add(packet{name: "a", bucket: "g", value: -3, relative: true})
+	agg.Add(packet{name: "b", bucket: "g", value: -4, relative: true})
+
+	s := agg.Snapshot()
 
-	if gauges["a"] != 25.1 {
-		t.Errorf("got %f for gauge a, expected 25.1", gauges["a"])
+	if s.gauges["a"] != 12 {
+		t.Errorf("got %f for gauge a, expected 12", s.gauges["a"])
 	}
 
-	if gauges["b"] != 90.1 {
-		t.Errorf("got %f for gauge b, expected 90.1", gauges["b"])
+	if s.deltas["a"] {
+		t.Errorf("gauge a marked relative, expected absolute")
 	}
 
-	readPacket(packet{name: "c", bucket: "ms", value: 15.3})
-	readPacket(packet{name: "c", bucket: "ms", value: 25.3})
-	readPacket(packet{name: "d", bucket: "ms", value: 90.3})
+	if s.gauges["b"] != -4 {
+		t.Errorf("got %f for gauge b, expected -4", s.gauges["b"])
+	}
 
-	if len(timers) != 2 {
-		t.Errorf("got %d timers, expected 2", len(timers))
+	if !s.deltas["b"] {
+		t.Errorf("gauge b marked absolute, expected relative")
 	}
 
-	if !reflect.DeepEqual(timers["c"], []float64{15.3, 25.3}) {
-		t.Errorf("got %+v for timer c, expected {15.3, 25.3}", timers["c"])
+	agg.Add(packet{name: "b", bucket: "g", value: -4, relative: true})
+	agg.Add(packet{name: "b", bucket: "g", value: 7})
+
+	if s = agg.Snapshot(); s.gauges["b"] != 7 || s.deltas["b"] {
+		t.Errorf("got %f (relative %t) for gauge b, expected absolute 7", s.gauges["b"], s.deltas["b"])
 	}
+}
+
+func TestReadTaggedPackets(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "c", value: 1})
+	agg.Add(packet{name: "a", bucket: "c", value: 2, tags: []string{"env:prod"}})
+	agg.Add(packet{name: "a", bucket: "c", value: 3, tags: []string{"env:prod"}})
+	agg.Add(packet{name: "a", bucket: "c", value: 4, tags: []string{"env:dev"}})
+
+	s := agg.Snapshot()
+
+	if len(s.counters) != 3 {
+		t.Errorf("got %d counters, expected 3", len(s.counters))
+	}
+
+	if s.counters["a"] != 1 {
+		t.Errorf("got %f for counter a, expected 1", s.counters["a"])
+	}
+
+	if s.counters["a|#env:prod"] != 5 {
+		t.Errorf("got %f for counter a|#env:prod, expected 5", s.counters["a|#env:prod"])
+	}
+
+	if s.counters["a|#env:dev"] != 4 {
+		t.Errorf("got %f for counter a|#env:dev, expected 4", s.counters["a|#env:dev"])
+	}
+}
+
+func TestAggregatorConcurrent(t *testing.T) {
+	agg := newAggregator(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				agg.Add(packet{name: fmt.Sprintf("k%d", j%10), bucket: "c", value: 1})
+				agg.Add(packet{name: fmt.Sprintf("t%d", i), bucket: "ms", value: float64(j)})
+			}
+		}(i)
+	}
+
+	// Snapshots taken while packets are being added must not lose any.
+	total, timed := 0.0, 0
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		s := agg.Snapshot()
+		for _, v := range s.counters {
+			total += v
+		}
+		for _, vs := range s.timers {
+			timed += len(vs)
+		}
+	}
+
+	if total != 8000 || timed != 8000 {
+		t.Errorf("got %f counted and %d timed, expected 8000 of each", total, timed)
+	}
+}
+
+func TestMergeSnapshots(t *testing.T) {
+	a := &snapshot{
+		counters: map[string]float64{"a": 1},
+		gauges:   map[string]float64{"b": 10, "c": 3, "d": 4},
+		timers:   map[string][]float64{"e": {3}},
+		sets:     map[string]map[string]struct{}{"f": {"x": {}}},
+		deltas:   map[string]bool{"d": true},
+	}
+
+	b := &snapshot{
+		counters: map[string]float64{"a": 2, "g": 5},
+		gauges:   map[string]float64{"b": 2, "c": 7, "d": -1},
+		timers:   map[string][]float64{"e": {2}},
+		sets:     map[string]map[string]struct{}{"f": {"x": {}, "y": {}}},
+		deltas:   map[string]bool{"b": true, "d": true},
+	}
+
+	s := mergeSnapshots(a, b)
+
+	expect := &snapshot{
+		counters: map[string]float64{"a": 3, "g": 5},
+		gauges:   map[string]float64{"b": 12, "c": 7, "d": 3},
+		timers:   map[string][]float64{"e": {2, 3}},
+		sets:     map[string]map[string]struct{}{"f": {"x": {}, "y": {}}},
+		deltas:   map[string]bool{"d": true},
+	}
+
+	if !reflect.DeepEqual(s, expect) {
+		t.Errorf("got %+v, expected %+v", s, expect)
+	}
+
+	if a.counters["a"] != 1 || b.counters["a"] != 2 || !reflect.DeepEqual(a.timers["e"], []float64{3}) {
+		t.Errorf("expected the merged snapshots to be unchanged")
+	}
+}
+
+func TestApplyGauges(t *testing.T) {
+	dst := map[string]float64{"a": 10, "b": 10}
+
+	applyGauges(dst, &snapshot{
+		gauges: map[string]float64{"a": 5, "b": -3, "c": 2},
+		deltas: map[string]bool{"b": true, "c": true},
+	})
 
-	if !reflect.DeepEqual(timers["d"], []float64{90.3}) {
-		t.Errorf("got %+v for timer d, expected {90.3}", timers["d"])
+	if !reflect.DeepEqual(dst, map[string]float64{"a": 5, "b": 7, "c": 2}) {
+		t.Errorf("unexpected gauges: %+v", dst)
 	}
 }
@@ -1,88 +1,223 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 type packet struct {
-	name   string
-	bucket string
-	value  float64
+	name     string
+	bucket   string
+	value    float64
+	member   string
+	relative bool
+	tags     []string
 }
 
-var packets = make(chan packet, 10000)
+func (p packet) key() string {
+	return buildKey(p.name, p.tags)
+}
 
-func listenTcp() {
-	listener, err := net.Listen("tcp", *address)
-	if err != nil {
-		log.Fatal("unable to listen on tcp %s: %s", *address, err)
-	}
+// Accepts connections from a tcp or unix stream listener and hands each to
+// handle, refusing any beyond tcpMaxConns, until the listener is closed. The
+// open connections are then closed, and it returns once the lines already
+// read have been handled.
+func acceptConns(listener net.Listener, handle func(net.Conn)) {
+	network := listener.Addr().Network()
+	conns := make(chan struct{}, max(*tcpMaxConns, 1))
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		active = make(map[net.Conn]struct{})
+	)
+
+	defer func() {
+		mu.Lock()
+		for conn := range active {
+			conn.Close()
+		}
+		mu.Unlock()
 
-	log.Printf("listening for events at tcp %s...\n", *address)
+		wg.Wait()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case conns <- struct{}{}:
+		default:
+			log.Printf("refusing connection from %s %s, already at %d connections\n", network, conn.RemoteAddr(), cap(conns))
+			conn.Close()
 			continue
 		}
 
-		log.Printf("new connection from tcp %s", conn.RemoteAddr())
+		log.Printf("new connection from %s %s", network, conn.RemoteAddr())
+
+		mu.Lock()
+		active[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(active, conn)
+				mu.Unlock()
+
+				<-conns
+				wg.Done()
+			}()
 
-		go handleTcpConn(conn)
+			handle(conn)
+		}()
 	}
 }
 
-func handleTcpConn(conn net.Conn) {
+var errLineTooLong = errors.New("line too long")
+
+// Handles each line as it arrives, so that long lived connections are
+// processed continuously. Lines longer than tcpMaxLine are discarded, and
+// connections that are idle for tcpTimeout are closed.
+func handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	msg := make([]byte, 0)
-	tmp := make([]byte, 8192)
+	network := conn.LocalAddr().Network()
+
+	r := newLineReader(conn, *tcpMaxLine)
 
 	for {
-		n, err := conn.Read(tmp)
-		if err != nil {
-			if err == io.EOF {
-				break
+		if *tcpTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(*tcpTimeout) * time.Second))
+		}
+
+		line, err := readLine(r, *tcpMaxLine)
+		if len(line) > 0 {
+			if *debug {
+				log.Printf("received %d bytes from %s %s: %s\n", len(line), network, conn.RemoteAddr(), string(line))
 			}
 
-			log.Printf("unable to read from tcp: %s\n", err)
+			handle(string(line))
+		}
+
+		switch err {
+		case nil:
+		case errLineTooLong:
+			log.Printf("discarding line longer than %d bytes from %s %s\n", *tcpMaxLine, network, conn.RemoteAddr())
+		case io.EOF:
+			return
+		default:
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("closing connection from %s %s: %s\n", network, conn.RemoteAddr(), err)
 			return
 		}
-		msg = append(msg, tmp[0:n]...)
 	}
+}
 
-	if *debug {
-		log.Printf("received %d bytes from tcp %s:\n%s\n", len(msg), conn.RemoteAddr(), string(msg))
+// Buffers a stream for readLine, with room for a line of limit bytes along
+// with its "\r\n".
+func newLineReader(conn io.Reader, limit int) *bufio.Reader {
+	return bufio.NewReaderSize(conn, max(limit, 0)+2)
+}
+
+// Reads a single line, without the trailing newline. A line longer than limit
+// bytes is skipped and errLineTooLong returned. A final line without a
+// newline is returned along with io.EOF.
+func readLine(r *bufio.Reader, limit int) (line []byte, err error) {
+	line, err = r.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errLineTooLong
+		}
+		return nil, err
+	}
+
+	// The buffer may be larger than asked for, so the limit is checked
+	// here as well.
+	if line = bytes.TrimRight(line, "\r\n"); len(line) > limit {
+		if err == nil {
+			err = errLineTooLong
+		}
+		return nil, err
 	}
 
-	handle(string(msg))
+	return line, err
 }
 
-func listenUdp() {
-	addr, err := net.ResolveUDPAddr("udp", *address)
-	if err != nil {
-		log.Fatal("unable to resolve service address: %s", err)
+// Opens n sockets on the same address. With more than one, each socket has
+// SO_REUSEPORT set so that the kernel spreads datagrams between them.
+func openUdp(network string, address string, n int) (listeners []*net.UDPConn, err error) {
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = reusePort
 	}
 
-	listener, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		log.Fatal("unable to listen on udp %s: %s", *address, err)
+	for i := 0; i < max(n, 1); i++ {
+		var pc net.PacketConn
+		if pc, err = lc.ListenPacket(context.Background(), network, address); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		l := pc.(*net.UDPConn)
+		listeners = append(listeners, l)
+
+		// Bind the remaining sockets to the port the first one was given,
+		// in case the address didn't specify one.
+		address = l.LocalAddr().String()
+
+		if *udpReadBuffer > 0 {
+			if err := l.SetReadBuffer(*udpReadBuffer); err != nil {
+				log.Printf("unable to set udp receive buffer to %d bytes: %s\n", *udpReadBuffer, err)
+			}
+		}
 	}
-	defer listener.Close()
 
-	log.Printf("listening for events at udp %s...\n", *address)
+	return
+}
 
-	msg := make([]byte, 512)
+func readUdp(listener *net.UDPConn) {
+	readDatagrams("udp", listener)
+}
+
+// Reads datagrams until the socket is closed, handling each one.
+func readDatagrams(network string, conn net.PacketConn) {
+	msg := make([]byte, max(*udpMaxSize, 1)+datagramSlack)
 
 	for {
-		n, _, err := listener.ReadFrom(msg)
+		n, truncated, err := readDatagram(conn, msg)
 		if err != nil {
 			if err == io.EOF {
 				continue
 			}
 
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			log.Printf("listener: unable to read: %s\n", err)
 			continue
 		}
@@ -91,15 +226,52 @@ func listenUdp() {
 			log.Printf("received metric: %s\n", string(msg[0:n]))
 		}
 
+		if truncated {
+			handleTruncated(network, msg[0:n])
+			continue
+		}
+
 		handle(string(msg[0:n]))
 	}
 }
 
+// Handles the complete lines of a datagram that was larger than the read
+// buffer, discarding the partial line at the end.
+func handleTruncated(network string, msg []byte) {
+	log.Printf("received a %s datagram larger than %d bytes, discarding the last line\n", network, len(msg))
+
+	countInternal(network+".truncated", 1)
+
+	if i := bytes.LastIndexByte(msg, '\n'); i >= 0 {
+		handle(string(msg[0:i]))
+	}
+}
+
+// Handles a message of one or more newline separated lines, counting the
+// lines that don't hold a valid metric. Metrics that a rule drops are counted
+// as received but aren't aggregated.
 func handle(msg string) {
-	for _, p := range parsePacket(msg) {
-		if *debug {
-			log.Printf("received packet: %+v\n", p)
+	packetsReceived.Add(1)
+
+	for _, line := range strings.Split(msg, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		ps := parsePacket(line)
+		if len(ps) == 0 {
+			badLines.Add(1)
+			continue
+		}
+		metricsReceived.Add(int64(len(ps)))
+
+		for _, p := range ps {
+			if *debug {
+				log.Printf("received packet: %+v\n", p)
+			}
+			if !dropMetric(p) {
+				aggregator.Add(p)
+			}
 		}
-		packets <- p
 	}
 }
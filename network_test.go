@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Waits up to a second for n packets to reach the aggregator.
+func waitPending(n int) {
+	deadline := time.Now().Add(time.Second)
+	for aggregator.Pending() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var readLineTests = []struct {
+	in     string
+	limit  int
+	lines  []string
+	errors []error
+}{
+	{"a:1|c\nb:2|c\n", 14, []string{"a:1|c", "b:2|c", ""}, []error{nil, nil, io.EOF}},
+	{"a:1|c\r\nb:2|c", 14, []string{"a:1|c", "b:2|c"}, []error{nil, io.EOF}},
+	{"0123456789012345678901234567890123456789\nb:2|c\n", 14, []string{"", "b:2|c", ""}, []error{errLineTooLong, nil, io.EOF}},
+	{"0123456789012345678901234567890123456789", 14, []string{""}, []error{io.EOF}},
+	{"a:1|c\nab:1|c\nb:2|c\r\n", 5, []string{"a:1|c", "", "b:2|c"}, []error{nil, errLineTooLong, nil}},
+	{"a:10|c\na:100|c", 5, []string{"", ""}, []error{errLineTooLong, io.EOF}},
+	{"0123456789abcdefghij\r\n0123456789abcdefghijk\n", 20, []string{"0123456789abcdefghij", ""}, []error{nil, errLineTooLong}},
+}
+
+func TestReadLine(t *testing.T) {
+	for _, s := range readLineTests {
+		r := newLineReader(strings.NewReader(s.in), s.limit)
+		for i := range s.lines {
+			line, err := readLine(r, s.limit)
+			if string(line) != s.lines[i] || err != s.errors[i] {
+				t.Errorf("%q line %d: got '%s' (%v), expected '%s' (%v)", s.in, i, line, err, s.lines[i], s.errors[i])
+			}
+		}
+	}
+}
+
+func TestHandleConn(t *testing.T) {
+	aggregator.Snapshot()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		handleConn(server)
+		close(done)
+	}()
+
+	client.Write([]byte("a:1|c\nb:2|g\n"))
+
+	// Lines are handled as they arrive, before the connection is closed.
+	waitPending(2)
+
+	s := aggregator.Snapshot()
+	if s.counters["a"] != 1 || s.gauges["b"] != 2 {
+		t.Errorf("got %+v, expected counter a and gauge b", s)
+	}
+
+	client.Write([]byte("c:3|ms"))
+	client.Close()
+	<-done
+
+	s = aggregator.Snapshot()
+	expect := map[string][]float64{"c": {3}}
+	if s.Count() != 1 || !reflect.DeepEqual(s.timers, expect) {
+		t.Errorf("got %+v, expected timers %+v", s, expect)
+	}
+}
+
+func TestHandleConnTimeout(t *testing.T) {
+	timeout := *tcpTimeout
+	defer func() { *tcpTimeout = timeout }()
+	*tcpTimeout = 1
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		handleConn(server)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("expected an idle connection to be closed")
+	}
+}
+
+func TestReadUdp(t *testing.T) {
+	size := *udpMaxSize
+	defer func() { *udpMaxSize = size }()
+	*udpMaxSize = 14
+
+	aggregator.Snapshot()
+	internal.Snapshot()
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		readUdp(listener)
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("a:1|c\nb:2|c"))
+	conn.Write([]byte("c:3|c\nd:4|c\ne:5|c"))
+
+	waitPending(4)
+
+	listener.Close()
+	<-done
+
+	expect := map[string]float64{"a": 1, "b": 2, "c": 3, "d": 4}
+	if s := aggregator.Snapshot(); !reflect.DeepEqual(s.counters, expect) {
+		t.Errorf("got %+v, expected %+v", s.counters, expect)
+	}
+
+	if s := internal.Snapshot(); s.counters["statsd.udp.truncated"] != 1 {
+		t.Errorf("got %+v, expected the truncated datagram to be counted", s.counters)
+	}
+}
+
+func TestOpenUdp(t *testing.T) {
+	listeners, err := openUdp("udp", "127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if len(listeners) != 4 {
+		t.Fatalf("got %d listeners, expected 4", len(listeners))
+	}
+
+	for _, l := range listeners[1:] {
+		if l.LocalAddr().String() != listeners[0].LocalAddr().String() {
+			t.Errorf("got address %s, expected %s", l.LocalAddr(), listeners[0].LocalAddr())
+		}
+	}
+}
+
+// Sends datagrams from several sockets, so that the kernel spreads them
+// between the readers, and reports how many were received each second.
+func BenchmarkReadUdp(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", n), func(b *testing.B) {
+			benchmarkReadUdp(b, n)
+		})
+	}
+}
+
+func benchmarkReadUdp(b *testing.B, n int) {
+	aggregator.Snapshot()
+
+	listeners, err := openUdp("udp", "127.0.0.1:0", n)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *net.UDPConn) {
+			readUdp(l)
+			wg.Done()
+		}(l)
+	}
+
+	const senders = 16
+	msg := []byte("a:1|c\nb:2|g\nc:3|ms\nd:4|s")
+
+	b.ResetTimer()
+
+	var sent sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sent.Add(1)
+		go func(i int) {
+			defer sent.Done()
+			conn, err := net.Dial("udp", listeners[0].LocalAddr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for j := i; j < b.N; j += senders {
+				conn.Write(msg)
+			}
+		}(i)
+	}
+	sent.Wait()
+
+	// Give the readers a moment to empty their receive buffers.
+	time.Sleep(100 * time.Millisecond)
+	b.StopTimer()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	wg.Wait()
+
+	count := aggregator.Pending()
+	aggregator.Snapshot()
+
+	b.ReportMetric(float64(count)/b.Elapsed().Seconds(), "packets/s")
+	b.ReportMetric(100*(1-float64(count)/float64(4*b.N)), "%lost")
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-var re = regexp.MustCompile("([a-zA-Z0-9_\\.,]+):(\\-?[0-9\\.]+)\\|(c|g|ms)(\\|@([0-9\\.]+))?")
+var re = regexp.MustCompile("([a-zA-Z0-9_\\.,]+):([^:|\\s]+)\\|(c|g|ms|s)(\\|@([0-9\\.]+))?(\\|#([^|\\s]+))?")
 
 func parsePacket(msg string) (packets []packet) {
 	packets = make([]packet, 0)
@@ -17,7 +18,25 @@ func parsePacket(msg string) (packets []packet) {
 		p := packet{
 			name:   match[1],
 			bucket: match[3],
-			value:  parseFloat(match[2]),
+		}
+
+		// Sets count distinct members, which may be any string. Every other
+		// bucket requires a finite numeric value, NaN and Inf can't be
+		// aggregated nor sent to any backend.
+		if p.bucket == "s" {
+			p.member = match[2]
+		} else {
+			v, err := strconv.ParseFloat(match[2], 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			p.value = v
+
+			// A gauge value with an explicit sign adjusts the current gauge
+			// rather than replacing it.
+			if p.bucket == "g" && (match[2][0] == '+' || match[2][0] == '-') {
+				p.relative = true
+			}
 		}
 
 		if len(match) >= 5 {
@@ -27,6 +46,10 @@ func parsePacket(msg string) (packets []packet) {
 			}
 		}
 
+		if match[7] != "" {
+			p.tags = parseTags(match[7])
+		}
+
 		packets = append(packets, p)
 	}
 
@@ -45,6 +68,53 @@ func parseSource(s string) (name string, source string) {
 	return s, ""
 }
 
+// Splits a comma separated list of tags, sorted and without duplicates so
+// that the same tags always produce the same key.
+// "role:web,env:prod" => ["env:prod", "role:web"]
+func parseTags(s string) (tags []string) {
+	tags = make([]string, 0)
+	for _, t := range strings.Split(s, ",") {
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	sort.Strings(tags)
+
+	n := 0
+	for i, t := range tags {
+		if i == 0 || t != tags[n-1] {
+			tags[n] = t
+			n++
+		}
+	}
+
+	return tags[:n]
+}
+
+// Joins a name and tags into the key used to aggregate a metric.
+// "my_key", []                   => "my_key"
+// "my_key", ["env:prod", "role"] => "my_key|#env:prod,role"
+func buildKey(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
+	}
+
+	return name + "|#" + strings.Join(tags, ",")
+}
+
+// Extracts a key into a name and tags, if present.
+// "my_key"                => "my_key", []
+// "my_key|#env:prod,role" => "my_key", ["env:prod", "role"]
+func parseKey(k string) (name string, tags []string) {
+	ss := strings.SplitN(k, "|#", 2)
+	if len(ss) == 2 {
+		return ss[0], strings.Split(ss[1], ",")
+	}
+
+	return k, nil
+}
+
 // Converts a string to a float, ignoring any errors.
 // In case of error, the float will be empty(0.0)
 func parseFloat(s string) (n float64) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -20,6 +21,14 @@ var parsePacketTests = []struct {
 	{"sampled.counter:4|c|@0.5", 1, "sampled.counter", "c", 8},
 	{"sampled.counter:4|c|@0.33", 1, "sampled.counter", "c", 12},
 	{"first.timer:123.4567|ms\nsecond.timer:456.7890|ms", 2, "first.timer", "ms", 123.4567},
+	{"not.numeric:abc|c", 0, "", "", 0},
+	{"not.finite:NaN|g", 0, "", "", 0},
+	{"not.finite:Inf|ms", 0, "", "", 0},
+	{"not.finite:-Infinity|g", 0, "", "", 0},
+	{"not.finite:1e999|c", 0, "", "", 0},
+	{"some.set:123|s", 1, "some.set", "s", 0},
+	{"tagged.counter:3|c|#env:prod", 1, "tagged.counter", "c", 3},
+	{"tagged.counter:3|c|@0.5|#env:prod", 1, "tagged.counter", "c", 6},
 }
 
 func TestParsePacket(t *testing.T) {
@@ -42,6 +51,95 @@ func TestParsePacket(t *testing.T) {
 	}
 }
 
+var parseSetTests = []struct {
+	msg    string
+	length int
+	name   string
+	member string
+}{
+	{"users:123|s", 1, "users", "123"},
+	{"users:abc-def|s", 1, "users", "abc-def"},
+	{"users:1|s\nusers:2|s", 2, "users", "1"},
+}
+
+func TestParseSet(t *testing.T) {
+	for _, s := range parseSetTests {
+		ps := parsePacket(s.msg)
+		if len(ps) != s.length {
+			t.Errorf("%s: got %d packets, expected %d", s.msg, len(ps), s.length)
+		}
+		if len(ps) > 0 {
+			if ps[0].name != s.name {
+				t.Errorf("%s: got name '%s', expected '%s'", s.msg, ps[0].name, s.name)
+			}
+			if ps[0].bucket != "s" {
+				t.Errorf("%s: got bucket '%s', expected 's'", s.msg, ps[0].bucket)
+			}
+			if ps[0].member != s.member {
+				t.Errorf("%s: got member '%s', expected '%s'", s.msg, ps[0].member, s.member)
+			}
+		}
+	}
+}
+
+var parseRelativeTests = []struct {
+	msg      string
+	value    float64
+	relative bool
+}{
+	{"some.gauge:5|g", 5, false},
+	{"some.gauge:+5|g", 5, true},
+	{"some.gauge:-5|g", -5, true},
+	{"some.counter:-5|c", -5, false},
+}
+
+func TestParseRelative(t *testing.T) {
+	for _, s := range parseRelativeTests {
+		ps := parsePacket(s.msg)
+		if len(ps) != 1 {
+			t.Fatalf("%s: got %d packets, expected 1", s.msg, len(ps))
+		}
+		if ps[0].value != s.value {
+			t.Errorf("%s: got value '%f', expected '%f'", s.msg, ps[0].value, s.value)
+		}
+		if ps[0].relative != s.relative {
+			t.Errorf("%s: got relative %t, expected %t", s.msg, ps[0].relative, s.relative)
+		}
+	}
+}
+
+var parseTagTests = []struct {
+	msg  string
+	key  string
+	tags []string
+}{
+	{"my.name:1|c", "my.name", nil},
+	{"my.name:1|c|#env:prod", "my.name|#env:prod", []string{"env:prod"}},
+	{"my.name:1|c|#role:web,env:prod", "my.name|#env:prod,role:web", []string{"env:prod", "role:web"}},
+	{"my.name:1|ms|@0.5|#canary,canary,env:prod", "my.name|#canary,env:prod", []string{"canary", "env:prod"}},
+	{"my.name:abc|s|#env:prod\nother:1|c", "my.name|#env:prod", []string{"env:prod"}},
+}
+
+func TestParseTags(t *testing.T) {
+	for _, s := range parseTagTests {
+		ps := parsePacket(s.msg)
+		if len(ps) == 0 {
+			t.Fatalf("%s: got no packets", s.msg)
+		}
+		if !reflect.DeepEqual(ps[0].tags, s.tags) {
+			t.Errorf("%s: got tags %+v, expected %+v", s.msg, ps[0].tags, s.tags)
+		}
+		if ps[0].key() != s.key {
+			t.Errorf("%s: got key '%s', expected '%s'", s.msg, ps[0].key(), s.key)
+		}
+
+		name, tags := parseKey(s.key)
+		if name != ps[0].name || !reflect.DeepEqual(tags, s.tags) {
+			t.Errorf("%s: got '%s' %+v from key, expected '%s' %+v", s.msg, name, tags, ps[0].name, s.tags)
+		}
+	}
+}
+
 var parseSourceTests = []struct {
 	in     string
 	name   string
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves the flushed metrics for prometheus to scrape. Counters are exposed
+// as running totals, timers as summaries with the quantiles of the most
+// recent interval, and gauges and sets as gauges.
+type prometheusBackend struct {
+	status
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	sets     map[string]float64
+	timers   map[string]*summary
+	server   *http.Server
+}
+
+// A timer's quantiles over the most recent interval, and the percentiles they
+// were calculated for, along with the total count and sum of every value it
+// has received.
+type summary struct {
+	tiles     []float64
+	quantiles map[float64]float64
+	count     int
+	sum       float64
+}
+
+func newPrometheusBackend(address string) (b *prometheusBackend, err error) {
+	if address == "" {
+		return nil, fmt.Errorf("specify a listen address with -prometheus or the PROMETHEUS environment variable")
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on tcp %s: %s", address, err)
+	}
+
+	b = &prometheusBackend{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		sets:     make(map[string]float64),
+		timers:   make(map[string]*summary),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", b)
+	b.server = &http.Server{Addr: l.Addr().String(), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := b.server.Serve(l); err != http.ErrServerClosed {
+			log.Printf("prometheus listener at %s stopped: %s\n", address, err)
+		}
+	}()
+
+	log.Printf("serving metrics for prometheus at http://%s/metrics\n", b.server.Addr)
+
+	return
+}
+
+// Stops serving metrics when shutting down, waiting for scrapes in progress.
+func (b *prometheusBackend) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+	defer cancel()
+
+	return b.server.Shutdown(ctx)
+}
+
+// Deletes the metrics that are served between flushes.
+func (b *prometheusBackend) delete(bucket string, match func(string) bool) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch bucket {
+	case "c":
+		return deleteKeys(b.counters, match)
+	case "g":
+		return deleteKeys(b.gauges, match)
+	case "ms":
+		return deleteKeys(b.timers, match)
+	case "s":
+		return deleteKeys(b.sets, match)
+	}
+
+	return nil
+}
+
+func (b *prometheusBackend) Name() string {
+	return "prometheus"
+}
+
+func (b *prometheusBackend) Flush(s *snapshot) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, v := range s.counters {
+		b.counters[k] += v
+	}
+
+	applyGauges(b.gauges, s)
+
+	for k, ms := range s.sets {
+		b.sets[k] = float64(len(ms))
+	}
+
+	for _, t := range b.timers {
+		t.quantiles = nil
+	}
+
+	for k, vs := range s.timers {
+		t, f := b.timers[k]
+		if !f {
+			t = &summary{}
+			b.timers[k] = t
+		}
+
+		t.tiles, t.quantiles = tilesFor(k), make(map[float64]float64)
+		for _, pct := range t.tiles {
+			if g := buildComplexGauge(k, vs, pct); g != nil {
+				t.quantiles[pct/100.0] = g.Max
+				if pct == 100.0 {
+					t.count += g.Count
+					t.sum += g.Sum
+				}
+			}
+		}
+	}
+
+	return b.record(nil)
+}
+
+func (b *prometheusBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b.write(w)
+}
+
+// A metric family and its samples, which must be written together.
+type family struct {
+	kind    string
+	samples []string
+}
+
+// Writes every metric in the text exposition format, in the order of their
+// keys so that the output doesn't change between scrapes. When metrics of
+// different types end up with the same name, the first type wins, in the
+// order counters, gauges, sets and timers. When different keys end up as the
+// same series, the first key wins. Scrapes only need b.mu, so that they don't
+// wait on a flush or a reload.
+func (b *prometheusBackend) write(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	families := make(map[string]*family)
+	seen := make(map[string]bool)
+	add := func(name string, kind string, series string, v float64) {
+		f, found := families[name]
+		if !found {
+			f = &family{kind: kind}
+			families[name] = f
+		}
+		if f.kind == kind && !seen[series] {
+			seen[series] = true
+			f.samples = append(f.samples, series+" "+formatPrometheus(v))
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(b.counters)) {
+		name, labels := parsePrometheus(k)
+		add(name+"_total", "counter", buildSeries(name+"_total", labels), b.counters[k])
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(b.gauges)) {
+		name, labels := parsePrometheus(k)
+		add(name, "gauge", buildSeries(name, labels), b.gauges[k])
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(b.sets)) {
+		name, labels := parsePrometheus(k)
+		add(name, "gauge", buildSeries(name, labels), b.sets[k])
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(b.timers)) {
+		t := b.timers[k]
+		name, labels := parsePrometheus(k)
+
+		// The quantile label of a summary takes precedence over a tag.
+		labels = slices.DeleteFunc(labels, func(l string) bool { return strings.HasPrefix(l, `quantile="`) })
+
+		for _, pct := range t.tiles {
+			q := pct / 100.0
+			v, found := t.quantiles[q]
+			if !found {
+				v = math.NaN()
+			}
+			ls := append([]string{`quantile="` + strconv.FormatFloat(q, 'g', -1, 64) + `"`}, labels...)
+			add(name, "summary", buildSeries(name, ls), v)
+		}
+		add(name, "summary", buildSeries(name+"_sum", labels), t.sum)
+		add(name, "summary", buildSeries(name+"_count", labels), float64(t.count))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(families)) {
+		f := families[name]
+		sort.Strings(f.samples)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
+
+func buildSeries(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatPrometheus(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Extracts a key into a valid metric name and sorted labels, with tags and
+// any source prefix as labels. Each label name appears once: a source prefix
+// takes precedence over a source tag, and a repeated tag over the ones before
+// it, in the sorted order of the tags.
+// "my_source,my.key|#env:prod"       => "my_key", [`env="prod"`, `source="my_source"`]
+// "my.key|#env:a,env:b,source:other" => "my_key", [`env="b"`, `source="other"`]
+func parsePrometheus(k string) (name string, labels []string) {
+	name, tags := parseKey(k)
+	name, source := parseSource(name)
+	name = sanitizePrometheus(name, true)
+
+	values := make(map[string]string)
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "true")
+		}
+		values[sanitizePrometheus(kv[0], false)] = kv[1]
+	}
+
+	if source != "" {
+		values["source"] = source
+	}
+
+	for _, l := range slices.Sorted(maps.Keys(values)) {
+		labels = append(labels, l+`="`+escaper.Replace(values[l])+`"`)
+	}
+
+	return
+}
+
+// Escapes a label value.
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Replaces every character that isn't allowed in a metric or label name with
+// an underscore, and adds a leading underscore to names that start with a
+// digit. Colons are only allowed in metric names.
+// "my.key-name" => "my_key_name"
+// "5xx.count"   => "_5xx_count"
+func sanitizePrometheus(s string, metric bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		case c == ':' && metric:
+		default:
+			b[i] = '_'
+		}
+	}
+
+	if len(b) == 0 || (b[0] >= '0' && b[0] <= '9') {
+		return "_" + string(b)
+	}
+
+	return string(b)
+}
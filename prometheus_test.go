@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var parsePrometheusTests = []struct {
+	key    string
+	name   string
+	labels []string
+}{
+	{"my.key", "my_key", nil},
+	{"my-key:total", "my_key:total", nil},
+	{"5xx.count", "_5xx_count", nil},
+	{"app01,my.key", "my_key", []string{`source="app01"`}},
+	{"my.key|#role:web,canary,host.name:a\"b", "my_key", []string{`canary="true"`, `host_name="a\"b"`, `role="web"`}},
+	{"app01,hits|#source:other", "hits", []string{`source="app01"`}},
+	{"dup|#env:a,env:b", "dup", []string{`env="b"`}},
+	{"dup|#host.name:a,host_name:b", "dup", []string{`host_name="b"`}},
+}
+
+func TestParsePrometheus(t *testing.T) {
+	for _, s := range parsePrometheusTests {
+		name, labels := parsePrometheus(s.key)
+		if name != s.name {
+			t.Errorf("%s: got name '%s', expected '%s'", s.key, name, s.name)
+		}
+		if !reflect.DeepEqual(labels, s.labels) {
+			t.Errorf("%s: got labels %+v, expected %+v", s.key, labels, s.labels)
+		}
+	}
+}
+
+func TestPrometheusBackend(t *testing.T) {
+	saved := tiles
+	defer func() { tiles = saved }()
+	tiles = []float64{100.0, 50.0}
+
+	b, err := newPrometheusBackend("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Flush(&snapshot{
+		counters: map[string]float64{"hits|#env:prod": 2},
+		gauges:   map[string]float64{"app01,queue.depth": 7},
+		timers:   map[string][]float64{"req.time": {10, 20, 30, 40}},
+		sets:     map[string]map[string]struct{}{"users": {"a": {}, "b": {}}},
+	})
+
+	b.Flush(&snapshot{
+		counters: map[string]float64{"hits|#env:prod": 3},
+		gauges:   map[string]float64{"app01,queue.depth": -2},
+		deltas:   map[string]bool{"app01,queue.depth": true},
+		timers:   map[string][]float64{"other.time": {5}},
+	})
+
+	buf := &bytes.Buffer{}
+	b.write(buf)
+
+	expect := strings.Join([]string{
+		`# TYPE hits_total counter`,
+		`hits_total{env="prod"} 5`,
+		`# TYPE other_time summary`,
+		`other_time_count 1`,
+		`other_time_sum 5`,
+		`other_time{quantile="0.5"} NaN`,
+		`other_time{quantile="1"} 5`,
+		`# TYPE queue_depth gauge`,
+		`queue_depth{source="app01"} 5`,
+		`# TYPE req_time summary`,
+		`req_time_count 4`,
+		`req_time_sum 100`,
+		`req_time{quantile="0.5"} NaN`,
+		`req_time{quantile="1"} NaN`,
+		`# TYPE users gauge`,
+		`users 2`,
+		``,
+	}, "\n")
+
+	if buf.String() != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+}
+
+func TestPrometheusBackendConflicts(t *testing.T) {
+	saved := tiles
+	defer func() { tiles = saved }()
+	tiles = []float64{100.0}
+
+	b, err := newPrometheusBackend("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Flush(&snapshot{
+		gauges: map[string]float64{"my.key": 1, "my_key": 2, "req": 3},
+		timers: map[string][]float64{"req": {5}, "lat|#quantile:x": {5}},
+	})
+
+	buf := &bytes.Buffer{}
+	b.write(buf)
+
+	expect := strings.Join([]string{
+		`# TYPE lat summary`,
+		`lat_count 1`,
+		`lat_sum 5`,
+		`lat{quantile="1"} 5`,
+		`# TYPE my_key gauge`,
+		`my_key 1`,
+		`# TYPE req gauge`,
+		`req 3`,
+		``,
+	}, "\n")
+
+	if buf.String() != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+}
+
+func TestPrometheusBackendServe(t *testing.T) {
+	b, err := newPrometheusBackend("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Flush(&snapshot{counters: map[string]float64{"hits": 1}})
+
+	// Scrapes don't wait on a flush or a reload.
+	flushMu.Lock()
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	flushMu.Unlock()
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("got content type '%s', expected text/plain", w.Header().Get("Content-Type"))
+	}
+
+	if w.Body.String() != "# TYPE hits_total counter\nhits_total 1\n" {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestPrometheusBackendClose(t *testing.T) {
+	b, err := newPrometheusBackend("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + b.server.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, expected 200", resp.StatusCode)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := http.Get("http://" + b.server.Addr + "/metrics"); err == nil {
+		t.Errorf("expected the listener to be closed")
+	}
+}
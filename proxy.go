@@ -4,21 +4,76 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"time"
 )
 
-func submitProxy() (err error) {
-	msg, num := buildPayload()
+// Forwards the raw metrics to another statsd over tcp, which does the
+// aggregation and submission itself.
+type proxyBackend struct {
+	status
+	address string
+	pending *snapshot
+}
+
+func newProxyBackend(address string) (b *proxyBackend, err error) {
+	if address == "" {
+		return nil, fmt.Errorf("specify a proxy address with -proxy or the PROXY environment variable")
+	}
+
+	log.Printf("sending metrics to proxy at %s\n", address)
+
+	return &proxyBackend{address: address}, nil
+}
+
+// Picks up a change to -proxy.
+func (b *proxyBackend) reload() error {
+	if *proxy == "" {
+		return fmt.Errorf("specify a proxy address with -proxy or the PROXY environment variable")
+	}
+
+	if *proxy != b.address {
+		b.address = *proxy
+		log.Printf("sending metrics to proxy at %s\n", b.address)
+	}
+
+	return nil
+}
+
+func (b *proxyBackend) Name() string {
+	return "proxy"
+}
+
+func (b *proxyBackend) Flush(s *snapshot) error {
+	return b.record(b.flush(s))
+}
+
+func (b *proxyBackend) flush(s *snapshot) (err error) {
+	if b.pending != nil {
+		s = mergeSnapshots(b.pending, s)
+		b.pending = nil
+	}
+
+	msg, num := buildPayload(s)
 
 	if num == 0 {
 		return
 	}
 
-	conn, err := net.Dial("tcp", *proxy)
+	// Anything that isn't sent is kept to be sent with the next flush.
+	defer func() {
+		if err != nil {
+			b.pending = s
+		}
+	}()
+
+	conn, err := net.DialTimeout("tcp", b.address, backendTimeout())
 	if err != nil {
 		return
 	}
 
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(backendTimeout()))
 
 	n, err := conn.Write(msg)
 	if err != nil {
@@ -29,35 +84,67 @@ func submitProxy() (err error) {
 		return fmt.Errorf("wrote %d of %d bytes", n, len(msg))
 	}
 
-	log.Printf("%d measurements sent to proxy\n", num)
-
-	resetAll()
+	log.Printf("%d measurements sent to proxy at %s\n", num, b.address)
 
 	return
 }
 
-func buildPayload() ([]byte, int) {
+func buildPayload(s *snapshot) ([]byte, int) {
 	result := ""
 
-	for k, v := range counters {
+	for k, v := range s.counters {
 		result += buildMetric(k, "c", v)
 	}
 
-	for k, v := range gauges {
-		result += buildMetric(k, "g", v)
+	for k, v := range s.gauges {
+		result += buildGauge(k, v, s.deltas[k])
 	}
 
-	n := len(counters) + len(gauges)
-	for k, vs := range timers {
+	n := len(s.counters) + len(s.gauges)
+	for k, vs := range s.timers {
 		n += len(vs)
 		for _, v := range vs {
 			result += buildMetric(k, "ms", v)
 		}
 	}
 
+	for k, ms := range s.sets {
+		n += len(ms)
+		for m := range ms {
+			result += buildLine(k, m, "s")
+		}
+	}
+
 	return []byte(result), n
 }
 
-func buildMetric(name string, bucket string, value float64) string {
-	return fmt.Sprintf("%s:%f|%s\n", name, value, bucket)
+func buildMetric(key string, bucket string, value float64) string {
+	return buildLine(key, fmt.Sprintf("%f", value), bucket)
+}
+
+// Builds a single statsd line from an aggregation key, moving any tags to
+// the end of the line.
+// "my_key|#env:prod", "1", "c" => "my_key:1|c|#env:prod\n"
+func buildLine(key string, value string, bucket string) string {
+	name, tags := parseKey(key)
+	if len(tags) > 0 {
+		return fmt.Sprintf("%s:%s|%s|#%s\n", name, value, bucket, strings.Join(tags, ","))
+	}
+
+	return fmt.Sprintf("%s:%s|%s\n", name, value, bucket)
+}
+
+// Builds a gauge line that a downstream statsd will interpret the same way.
+// Relative gauges keep an explicit sign, while negative absolute gauges are
+// reset to zero first so the value isn't mistaken for a decrement.
+func buildGauge(key string, value float64, relative bool) string {
+	if relative {
+		return buildLine(key, fmt.Sprintf("%+f", value), "g")
+	}
+
+	if value < 0 {
+		return buildMetric(key, "g", 0) + buildMetric(key, "g", value)
+	}
+
+	return buildMetric(key, "g", value)
 }
@@ -1,27 +1,31 @@
 package main
 
 import (
+	"io/ioutil"
+	"net"
 	"sort"
 	"strings"
 	"testing"
 )
 
 func TestBuildPayload(t *testing.T) {
-	counters = make(map[string]float64)
-	gauges = make(map[string]float64)
-	timers = make(map[string][]float64)
+	agg := newAggregator(4)
 
-	readPacket(packet{name: "a", bucket: "c", value: 15})
-	readPacket(packet{name: "a", bucket: "c", value: 25})
-	readPacket(packet{name: "b", bucket: "c", value: 90})
+	agg.Add(packet{name: "a", bucket: "c", value: 15})
+	agg.Add(packet{name: "a", bucket: "c", value: 25})
+	agg.Add(packet{name: "b", bucket: "c", value: 90})
 
-	readPacket(packet{name: "a", bucket: "g", value: 15.1})
-	readPacket(packet{name: "a", bucket: "g", value: 25.1})
-	readPacket(packet{name: "b", bucket: "g", value: 90.1})
+	agg.Add(packet{name: "a", bucket: "g", value: 15.1})
+	agg.Add(packet{name: "a", bucket: "g", value: 25.1})
+	agg.Add(packet{name: "b", bucket: "g", value: 90.1})
 
-	readPacket(packet{name: "c", bucket: "ms", value: 15.3})
-	readPacket(packet{name: "c", bucket: "ms", value: 25.3})
-	readPacket(packet{name: "d", bucket: "ms", value: 90.3})
+	agg.Add(packet{name: "c", bucket: "ms", value: 15.3})
+	agg.Add(packet{name: "c", bucket: "ms", value: 25.3})
+	agg.Add(packet{name: "d", bucket: "ms", value: 90.3})
+
+	agg.Add(packet{name: "e", bucket: "s", member: "1"})
+	agg.Add(packet{name: "e", bucket: "s", member: "abc"})
+	agg.Add(packet{name: "e", bucket: "s", member: "1"})
 
 	expect := sortLines(
 		"a:40.000000|c\n" +
@@ -30,17 +34,59 @@ func TestBuildPayload(t *testing.T) {
 			"b:90.100000|g\n" +
 			"c:15.300000|ms\n" +
 			"c:25.300000|ms\n" +
-			"d:90.300000|ms\n")
+			"d:90.300000|ms\n" +
+			"e:1|s\n" +
+			"e:abc|s\n")
 
-	buf, num := buildPayload()
+	buf, num := buildPayload(agg.Snapshot())
 	got := sortLines(string(buf))
 
 	if expect != string(got) {
 		t.Errorf("got '%s', expected '%s'", string(got), expect)
 	}
 
-	if num != 7 {
-		t.Errorf("got %d measurements, expected 7", num)
+	if num != 9 {
+		t.Errorf("got %d measurements, expected 9", num)
+	}
+}
+
+var buildGaugeTests = []struct {
+	value    float64
+	relative bool
+	expect   string
+}{
+	{5, false, "a:5.000000|g\n"},
+	{-5, false, "a:0.000000|g\na:-5.000000|g\n"},
+	{5, true, "a:+5.000000|g\n"},
+	{-5, true, "a:-5.000000|g\n"},
+}
+
+func TestBuildGauge(t *testing.T) {
+	for _, s := range buildGaugeTests {
+		got := buildGauge("a", s.value, s.relative)
+		if got != s.expect {
+			t.Errorf("%f (relative %t): got '%s', expected '%s'", s.value, s.relative, got, s.expect)
+		}
+	}
+}
+
+func TestBuildPayloadTags(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "c", value: 1, tags: []string{"env:prod", "role:web"}})
+	agg.Add(packet{name: "b", bucket: "g", value: 2, relative: true, tags: []string{"env:prod"}})
+	agg.Add(packet{name: "c", bucket: "s", member: "x", tags: []string{"env:prod"}})
+
+	expect := sortLines(
+		"a:1.000000|c|#env:prod,role:web\n" +
+			"b:+2.000000|g|#env:prod\n" +
+			"c:x|s|#env:prod\n")
+
+	buf, _ := buildPayload(agg.Snapshot())
+	got := sortLines(string(buf))
+
+	if expect != got {
+		t.Errorf("got '%s', expected '%s'", got, expect)
 	}
 }
 
@@ -49,3 +95,50 @@ func sortLines(s string) string {
 	sort.Strings(ss)
 	return strings.Join(ss, "\n")
 }
+
+func TestProxyBackendFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	accept := func(l net.Listener) {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		received <- string(buf)
+	}
+	go accept(l)
+
+	addr := l.Addr().String()
+	b := &proxyBackend{address: addr}
+
+	l.Close()
+	if err := b.Flush(&snapshot{counters: map[string]float64{"a": 1}}); err == nil {
+		t.Fatalf("expected the flush to fail")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("unable to listen again on %s: %s", addr, err)
+	}
+	defer l.Close()
+
+	go accept(l)
+
+	if err := b.Flush(&snapshot{counters: map[string]float64{"a": 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; got != "a:3.000000|c\n" {
+		t.Errorf("got '%s', expected the failed flush to be included", got)
+	}
+
+	if b.pending != nil {
+		t.Errorf("expected nothing to be pending")
+	}
+}
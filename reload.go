@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Settings that can change while running, on SIGHUP. Every other setting
+// needs a restart.
+var reloadable = map[string]bool{
+	"flush":                   true,
+	"percentiles":             true,
+	"user":                    true,
+	"token":                   true,
+	"source":                  true,
+	"api":                     true,
+	"tags":                    true,
+	"batch":                   true,
+	"concurrency":             true,
+	"retry-age":               true,
+	"proxy":                   true,
+	"graphite":                true,
+	"graphite-prefix":         true,
+	"graphite-counter-prefix": true,
+	"graphite-timer-prefix":   true,
+	"graphite-gauge-prefix":   true,
+	"graphite-set-prefix":     true,
+	"influxdb":                true,
+	"influxdb-database":       true,
+	"influxdb-bucket":         true,
+	"influxdb-org":            true,
+	"influxdb-token":          true,
+	"influxdb-precision":      true,
+	"influxdb-batch":          true,
+}
+
+// Settings whose values are never logged.
+var secrets = map[string]bool{
+	"token":          true,
+	"influxdb-token": true,
+	"http-token":     true,
+}
+
+// A setting that differs between the running and the reloaded configuration.
+type change struct {
+	name string
+	from string
+	to   string
+}
+
+func (c change) String() string {
+	if c.name == "metrics" {
+		return fmt.Sprintf("[[metrics]] changed from %q to %q", c.from, c.to)
+	}
+
+	if secrets[c.name] {
+		return fmt.Sprintf("-%s changed", c.name)
+	}
+
+	return fmt.Sprintf("-%s changed from %q to %q", c.name, c.from, c.to)
+}
+
+// Re-reads the configuration and applies the changes that are safe while
+// running, keeping everything that has been aggregated. The reload is
+// rejected, leaving every setting as it was, if the configuration is invalid
+// or changes a setting that needs a restart.
+func reload() (changes []change, err error) {
+	values, rules, err := resolveConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var fixed []string
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if v := flag.Lookup(name).Value.String(); v != values[name] {
+			changes = append(changes, change{name, v, values[name]})
+			if !reloadable[name] {
+				fixed = append(fixed, "-"+name)
+			}
+		}
+	}
+
+	if len(fixed) > 0 {
+		return nil, fmt.Errorf("%s can't be changed without a restart", strings.Join(fixed, ", "))
+	}
+
+	// The metric rules can always change, and are replaced as a whole.
+	from, to := formatRules(getRules()), formatRules(rules)
+
+	if len(changes) == 0 && from == to {
+		return
+	}
+
+	// Waits for any flush to finish, and holds off the next one, so that
+	// backends never see a mix of old and new settings.
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	if err = applyChanges(changes, false); err != nil {
+		applyChanges(changes, true)
+		return nil, err
+	}
+
+	if from != to {
+		setRules(rules)
+		changes = append(changes, change{"metrics", from, to})
+	}
+
+	storeAdminSettings()
+
+	return
+}
+
+// Describes the metric rules, in order.
+func formatRules(rules []metricRule) string {
+	ss := make([]string, len(rules))
+	for i, r := range rules {
+		ss[i] = r.String()
+	}
+
+	return strings.Join(ss, "; ")
+}
+
+// Sets the changed flags to their new values, or back to their old ones, and
+// passes them on to the backends.
+func applyChanges(changes []change, undo bool) error {
+	for _, c := range changes {
+		v := c.to
+		if undo {
+			v = c.from
+		}
+
+		if err := flag.Lookup(c.name).Value.Set(v); err != nil {
+			return fmt.Errorf("invalid -%s %q: %s", c.name, v, err)
+		}
+	}
+
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	for _, b := range backends {
+		if r, ok := b.(reloader); ok {
+			if err := r.reload(); err != nil {
+				return fmt.Errorf("unable to reload %s: %s", b.Name(), err)
+			}
+		}
+	}
+
+	tiles = buildTiles(*percentiles)
+
+	return nil
+}
+
+// Reloads the configuration, logging what changed or why it was rejected.
+// Returns the changes that were applied.
+func reloadConfig() []change {
+	changes, err := reload()
+	if err != nil {
+		log.Printf("configuration reload rejected: %s\n", err)
+		return nil
+	}
+
+	if len(changes) == 0 {
+		log.Printf("configuration reloaded, nothing changed\n")
+		return nil
+	}
+
+	for _, c := range changes {
+		log.Printf("configuration reloaded, %s\n", c)
+	}
+
+	return changes
+}
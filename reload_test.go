@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	defer saveFlags()()
+	defer setRules(getRules())
+
+	saved, savedTiles := backends, tiles
+	defer func() { backends, tiles = saved, savedTiles }()
+
+	path := writeConfig(t, `
+backends = ["proxy"]
+percentiles = [95]
+
+[librato]
+source = "a"
+token = "old"
+
+[proxy]
+address = "127.0.0.1:8125"
+`)
+	t.Setenv("CONFIG", path)
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newProxyBackend(*proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends = []Backend{b}
+	tiles = buildTiles(*percentiles)
+
+	os.WriteFile(path, []byte(`
+backends = ["proxy"]
+percentiles = [95, 99]
+
+[librato]
+source = "b"
+token = "new"
+
+[proxy]
+address = "127.0.0.1:8126"
+`), 0644)
+
+	changes, err := reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.String())
+	}
+
+	expect := []string{
+		`-percentiles changed from "95" to "95,99"`,
+		`-proxy changed from "127.0.0.1:8125" to "127.0.0.1:8126"`,
+		`-source changed from "a" to "b"`,
+		`-token changed`,
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Errorf("got %q, expected %q", lines, expect)
+	}
+
+	source := flag.Lookup("source").Value.String()
+	if !reflect.DeepEqual(tiles, []float64{100, 95, 99}) || b.address != "127.0.0.1:8126" || source != "b" {
+		t.Errorf("got %v, %s, %s, expected the new settings to be applied", tiles, b.address, source)
+	}
+
+	if changes, err := reload(); err != nil || len(changes) != 0 {
+		t.Errorf("got %+v (%v), expected nothing to change", changes, err)
+	}
+
+	// A setting that needs a restart rejects the whole reload.
+	os.WriteFile(path, []byte(`
+backends = ["proxy"]
+listen = "udp://127.0.0.1:8125"
+percentiles = [90]
+
+[proxy]
+address = "127.0.0.1:8126"
+`), 0644)
+
+	if _, err := reload(); err == nil || err.Error() != "-listen can't be changed without a restart" {
+		t.Errorf("got %v, expected the listeners to need a restart", err)
+	}
+
+	// So does an invalid configuration, leaving the old settings in place.
+	os.WriteFile(path, []byte(`
+backends = ["proxy"]
+percentiles = [90]
+
+[librato]
+source = "b"
+token = "new"
+
+[proxy]
+address = ""
+`), 0644)
+
+	if _, err := reload(); err == nil || !strings.Contains(err.Error(), "the proxy backend requires -proxy") {
+		t.Errorf("got %v, expected the proxy address to be required", err)
+	}
+
+	if *percentiles != "95,99" || *proxy != "127.0.0.1:8126" || !reflect.DeepEqual(tiles, []float64{100, 95, 99}) || b.address != "127.0.0.1:8126" {
+		t.Errorf("got %s, %s, %v, %s, expected the previous settings", *percentiles, *proxy, tiles, b.address)
+	}
+	// The metric rules are replaced as a whole.
+	os.WriteFile(path, []byte(`
+backends = ["proxy"]
+percentiles = [95, 99]
+
+[librato]
+source = "b"
+token = "new"
+
+[proxy]
+address = "127.0.0.1:8126"
+
+[[metrics]]
+match = "debug.*"
+drop = true
+`), 0644)
+
+	changes, err = reload()
+	if err != nil || len(changes) != 1 || changes[0].String() != `[[metrics]] changed from "" to "match \"debug.*\" drop"` {
+		t.Errorf("got %q (%v), expected the rules to change", changes, err)
+	}
+
+	if r := findRule("debug.hits"); r == nil || !r.drop {
+		t.Errorf("got %+v, expected the new rule to apply", r)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	retryBackoff    = 5 * time.Second
+	retryMaxBackoff = 5 * time.Minute
+)
+
+// A batch that failed to submit, waiting to be sent again. The batch keeps
+// the time it was measured at, so a late retry is recorded at the right time.
+type retry struct {
+	path     string
+	body     payload
+	created  time.Time
+	next     time.Time
+	attempts int
+	file     string
+}
+
+// Holds failed batches in memory until they are sent, expire or are pushed
+// out by newer batches.
+type retryBacklog struct {
+	mu      sync.Mutex
+	entries []*retry
+	size    int
+}
+
+var backlog = &retryBacklog{}
+
+// Queues a batch that has just failed for the first time, keeping a copy in
+// the spool if there is one.
+func (b *retryBacklog) push(path string, body payload, now time.Time) {
+	r := &retry{path: path, body: body, created: now}
+
+	if spooler != nil {
+		if err := spooler.write(r); err != nil {
+			log.Printf("unable to spool %d measurements: %s\n", body.Count(), err)
+		}
+	}
+
+	b.requeue(r, now)
+}
+
+// Queues batches read back from the spool to be retried right away.
+func (b *retryBacklog) restore(rs []*retry, now time.Time) {
+	for _, r := range rs {
+		r.next = now
+
+		b.mu.Lock()
+		b.add(r)
+		b.mu.Unlock()
+	}
+}
+
+// Queues a batch to be retried after a backoff based on the number of
+// attempts so far.
+func (b *retryBacklog) requeue(r *retry, now time.Time) {
+	r.attempts++
+	r.next = now.Add(backoff(r.attempts))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.add(r)
+}
+
+// Adds a batch to the backlog, dropping the oldest batches if it is full.
+// The caller must hold the lock.
+func (b *retryBacklog) add(r *retry) {
+	if r.body.Count() > *retrySize {
+		discard(r)
+		return
+	}
+
+	for b.size+r.body.Count() > *retrySize && len(b.entries) > 0 {
+		discard(b.entries[0])
+		b.size -= b.entries[0].body.Count()
+		b.entries = b.entries[1:]
+	}
+
+	b.entries = append(b.entries, r)
+	b.size += r.body.Count()
+}
+
+// Removes and returns the batches that are due to be retried, dropping any
+// that have become too old to send.
+func (b *retryBacklog) due(now time.Time) (rs []*retry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	maxAge := time.Duration(*retryAge) * time.Second
+
+	n := 0
+	for _, r := range b.entries {
+		switch {
+		case now.Sub(r.created) > maxAge:
+			discard(r)
+			b.size -= r.body.Count()
+		case !now.Before(r.next):
+			rs = append(rs, r)
+			b.size -= r.body.Count()
+		default:
+			b.entries[n] = r
+			n++
+		}
+	}
+	b.entries = b.entries[:n]
+
+	return
+}
+
+// Returns the number of measurements waiting to be retried.
+func (b *retryBacklog) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+// Returns an exponential backoff for the given attempt, with up to half of
+// it randomized so that retries from many hosts don't arrive together.
+func backoff(attempts int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < attempts && d < retryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > retryMaxBackoff {
+		d = retryMaxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryLibrato() {
+	t := time.NewTicker(time.Second)
+
+	for now := range t.C {
+		retryDue(now)
+	}
+}
+
+// Retries every batch in the backlog that is due. The batches are posted one
+// after another, so the settings are copied rather than holding flushMu,
+// which would hold up reloads and everything waiting behind them.
+func retryDue(now time.Time) {
+	flushMu.RLock()
+	due, c := backlog.due(now), currentLibrato()
+	flushMu.RUnlock()
+
+	for _, r := range due {
+		err := c.post(r.path, r.body)
+		if err == nil {
+			log.Printf("%d measurements sent to librato after %d attempts\n", r.body.Count(), r.attempts+1)
+			unspool(r)
+			continue
+		}
+
+		log.Printf("unable to retry %d measurements (attempt %d): %s\n", r.body.Count(), r.attempts+1, err)
+
+		if retryable(err) {
+			backlog.requeue(r, time.Now())
+		} else {
+			discard(r)
+		}
+	}
+}
+
+// Gives up on a batch for good.
+func discard(r *retry) {
+	dropped(r.body.Count())
+	unspool(r)
+}
+
+func unspool(r *retry) {
+	if spooler != nil {
+		spooler.remove(r)
+	}
+}
+
+// Records measurements that will never be sent, both in the log and as a
+// counter so the loss shows up alongside everything else.
+func dropped(n int) {
+	log.Printf("dropped %d measurements\n", n)
+
+	countInternal("librato.dropped", float64(n))
+}
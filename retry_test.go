@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryBacklogDue(t *testing.T) {
+	b := &retryBacklog{}
+	now := time.Now()
+
+	b.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "a"}}}, now)
+	b.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "b"}, {Name: "c"}}}, now)
+
+	if b.Count() != 3 {
+		t.Errorf("got %d measurements in backlog, expected 3", b.Count())
+	}
+
+	if rs := b.due(now); len(rs) != 0 {
+		t.Errorf("got %d batches due immediately, expected 0", len(rs))
+	}
+
+	rs := b.due(now.Add(retryBackoff))
+	if len(rs) != 2 {
+		t.Fatalf("got %d batches due after backoff, expected 2", len(rs))
+	}
+
+	if rs[0].attempts != 1 || rs[0].path != "/v1/metrics" {
+		t.Errorf("unexpected retry: %+v", rs[0])
+	}
+
+	if b.Count() != 0 {
+		t.Errorf("got %d measurements in backlog, expected 0", b.Count())
+	}
+
+	b.requeue(rs[0], now)
+
+	if b.Count() != 1 || b.entries[0].attempts != 2 {
+		t.Errorf("got %d measurements after %d attempts, expected 1 after 2", b.Count(), b.entries[0].attempts)
+	}
+}
+
+func TestRetryBacklogLimits(t *testing.T) {
+	size, age := *retrySize, *retryAge
+	defer func() { *retrySize, *retryAge = size, age }()
+	*retrySize, *retryAge = 3, 60
+
+	b := &retryBacklog{}
+	now := time.Now()
+
+	b.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "a"}}}, now)
+	b.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "b"}, {Name: "c"}}}, now)
+	b.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "d"}}}, now.Add(time.Minute))
+
+	if b.Count() != 3 || len(b.entries) != 2 {
+		t.Errorf("got %d measurements in %d batches, expected 3 in 2", b.Count(), len(b.entries))
+	}
+
+	if b.entries[0].body.(*Measurement).Counters[0].Name != "b" {
+		t.Errorf("expected the oldest batch to be dropped")
+	}
+
+	b.push("/v1/metrics", &Measurement{Counters: make([]*Counter, 4)}, now)
+
+	if b.Count() != 3 {
+		t.Errorf("got %d measurements in backlog, expected an oversized batch to be dropped", b.Count())
+	}
+
+	rs := b.due(now.Add(90 * time.Second))
+	if len(rs) != 1 || rs[0].body.(*Measurement).Counters[0].Name != "d" {
+		t.Errorf("got %d batches due, expected only the batch that hasn't expired", len(rs))
+	}
+
+	if b.Count() != 0 {
+		t.Errorf("got %d measurements in backlog, expected 0", b.Count())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for i, d := range []time.Duration{retryBackoff, 2 * retryBackoff, 4 * retryBackoff} {
+		got := backoff(i + 1)
+		if got < d/2 || got > d {
+			t.Errorf("attempt %d: got %s, expected between %s and %s", i+1, got, d/2, d)
+		}
+	}
+
+	if got := backoff(100); got > retryMaxBackoff {
+		t.Errorf("got %s, expected at most %s", got, retryMaxBackoff)
+	}
+}
+
+func TestRetryDueUnlocked(t *testing.T) {
+	unlocked := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A reload must be able to go ahead while a retry is being sent.
+		locked := make(chan struct{})
+		go func() {
+			flushMu.Lock()
+			flushMu.Unlock()
+			close(locked)
+		}()
+
+		select {
+		case <-locked:
+			unlocked = true
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	libratoUrl = ts.URL
+	defer func() { libratoUrl = "https://metrics-api.librato.com" }()
+
+	saved := backlog
+	defer func() { backlog = saved }()
+	backlog = &retryBacklog{}
+
+	now := time.Now()
+	backlog.push("/v1/metrics", &Measurement{Counters: []*Counter{{Name: "a"}}}, now)
+	retryDue(now.Add(retryMaxBackoff))
+
+	if !unlocked {
+		t.Errorf("expected flushMu not to be held while retrying")
+	}
+
+	if backlog.Count() != 0 {
+		t.Errorf("got %d measurements in backlog, expected the retry to succeed", backlog.Count())
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"syscall"
+)
+
+func reusePort(network string, address string, c syscall.RawConn) (err error) {
+	e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	})
+	if e != nil {
+		return e
+	}
+
+	return
+}
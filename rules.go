@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Settings for the metrics whose names match a pattern, from the [[metrics]]
+// tables of a config file. A pattern is a name, a folder ending in ".*" that
+// matches every name in it, or "*" that matches every name.
+type metricRule struct {
+	match       string
+	percentiles string
+	drop        bool
+	tiles       []float64
+}
+
+func (r metricRule) String() string {
+	s := fmt.Sprintf("match %q", r.match)
+	if r.percentiles != "" {
+		s += fmt.Sprintf(" percentiles %q", r.percentiles)
+	}
+	if r.drop {
+		s += " drop"
+	}
+
+	return s
+}
+
+// The rules in effect, which are replaced as a whole when the configuration
+// is reloaded.
+var metricRules atomic.Pointer[[]metricRule]
+
+func setRules(rules []metricRule) {
+	metricRules.Store(&rules)
+}
+
+func getRules() []metricRule {
+	if rules := metricRules.Load(); rules != nil {
+		return *rules
+	}
+
+	return nil
+}
+
+// Returns the first rule whose pattern matches the name of a key, without
+// its tags or source, if there is one.
+// "app01,api.hits|#env:prod" => the rule for "api.*"
+func findRule(k string) *metricRule {
+	rules := getRules()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	name, _ := parseKey(k)
+	name, _ = parseSource(name)
+
+	for i := range rules {
+		if ruleMatches(rules[i].match, name) {
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Reports whether a pattern matches a name.
+// "api.*", "api.errors.500" => true
+// "api.*", "api"            => false
+func ruleMatches(pattern string, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if folder, found := strings.CutSuffix(pattern, "*"); found {
+		return strings.HasPrefix(name, folder)
+	}
+
+	return pattern == name
+}
+
+// Reports whether a pattern is a name, a folder ending in ".*" or "*".
+func validPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	name, _ := strings.CutSuffix(pattern, ".*")
+	return name != "" && !strings.ContainsAny(name, "*:|@# ")
+}
+
+// Returns the percentiles calculated for a timer, which a rule may set in
+// place of -percentiles.
+func tilesFor(k string) []float64 {
+	if r := findRule(k); r != nil && r.tiles != nil {
+		return r.tiles
+	}
+
+	return tiles
+}
+
+// Reports whether a rule drops a received metric.
+func dropMetric(p packet) bool {
+	r := findRule(p.name)
+	return r != nil && r.drop
+}
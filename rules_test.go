@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var ruleMatchesTests = []struct {
+	pattern string
+	name    string
+	expect  bool
+}{
+	{"api.hits", "api.hits", true},
+	{"api.hits", "api.hits.500", false},
+	{"api.*", "api.errors.500", true},
+	{"api.*", "api", false},
+	{"api.*", "apis.hits", false},
+	{"*", "anything", true},
+}
+
+func TestRuleMatches(t *testing.T) {
+	for _, s := range ruleMatchesTests {
+		if got := ruleMatches(s.pattern, s.name); got != s.expect {
+			t.Errorf("%s, %s: got %t, expected %t", s.pattern, s.name, got, s.expect)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for _, p := range []string{"api.hits", "api.*", "*"} {
+		if !validPattern(p) {
+			t.Errorf("%s: expected a valid pattern", p)
+		}
+	}
+
+	for _, p := range []string{"", ".*", "api*", "api.*.hits", "a|b", "a b"} {
+		if validPattern(p) {
+			t.Errorf("%s: expected an invalid pattern", p)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	defer setRules(getRules())
+
+	setRules([]metricRule{
+		{match: "api.slow", percentiles: "99", tiles: buildTiles("99")},
+		{match: "api.*", percentiles: "50", tiles: buildTiles("50")},
+		{match: "debug.*", drop: true},
+	})
+
+	if got := tilesFor("app01,api.slow|#env:prod"); !reflect.DeepEqual(got, []float64{100, 99}) {
+		t.Errorf("got %v, expected the first matching rule's percentiles", got)
+	}
+
+	if got := tilesFor("api.fast"); !reflect.DeepEqual(got, []float64{100, 50}) {
+		t.Errorf("got %v, expected the folder's percentiles", got)
+	}
+
+	if got := tilesFor("debug.time"); !reflect.DeepEqual(got, tiles) {
+		t.Errorf("got %v, expected the global percentiles", got)
+	}
+
+	aggregator.Snapshot()
+	handle("debug.hits:1|c\napi.hits:1|c\napp01,debug.hits:1|c")
+
+	if s := aggregator.Snapshot(); !reflect.DeepEqual(s.counters, map[string]float64{"api.hits": 1}) {
+		t.Errorf("got %+v, expected the debug metrics to be dropped", s.counters)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+// SO_REUSEPORT, which the syscall package doesn't define for linux. Its value
+// differs on mips.
+const soReusePort = 0xf
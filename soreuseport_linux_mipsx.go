@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package main
+
+// SO_REUSEPORT on linux/mips, which the syscall package doesn't define.
+const soReusePort = 0x200
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps a copy of every batch in the retry backlog on disk, so that batches
+// which haven't been sent survive a restart.
+type spool struct {
+	dir   string
+	limit int64
+
+	mu    sync.Mutex
+	size  int64
+	seq   int
+	files map[string]int64
+}
+
+// A batch as written to the spool.
+type spoolEntry struct {
+	Path    string          `json:"path"`
+	Created int64           `json:"created"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// The spool in use, or nil if spooling is disabled.
+var spooler *spool
+
+func newSpool(dir string, limit int64) (s *spool, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	s = &spool{dir: dir, limit: limit, files: make(map[string]int64)}
+	return
+}
+
+// Opens the spool directory and queues any batches left from a previous run.
+func startSpool() (err error) {
+	if spooler, err = newSpool(*spoolDir, *spoolSize*1024*1024); err != nil {
+		return
+	}
+
+	rs, err := spooler.load()
+	if err != nil {
+		return
+	}
+
+	if len(rs) > 0 {
+		log.Printf("replaying %d spooled batches from %s\n", len(rs), *spoolDir)
+		backlog.restore(rs, time.Now())
+	}
+
+	log.Printf("spooling failed measurements to %s\n", *spoolDir)
+
+	return
+}
+
+// Writes a batch to the spool, unless doing so would exceed the size limit.
+func (s *spool) write(r *retry) (err error) {
+	body, err := json.Marshal(r.body)
+	if err != nil {
+		return
+	}
+
+	buf, err := json.Marshal(&spoolEntry{Path: r.path, Created: r.created.Unix(), Body: body})
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(buf)) > s.limit {
+		return fmt.Errorf("spool is full (%d of %d bytes)", s.size, s.limit)
+	}
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d.json", r.created.UnixNano(), s.seq))
+
+	// Write to a temporary file first so that a crash never leaves a
+	// partial batch behind.
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if err = os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	r.file = name
+	s.files[name] = int64(len(buf))
+	s.size += int64(len(buf))
+
+	return
+}
+
+// Removes a batch from the spool once it has been sent or dropped.
+func (s *spool) remove(r *retry) {
+	if r.file == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(r.file); err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove spooled batch %s: %s\n", r.file, err)
+	}
+
+	s.size -= s.files[r.file]
+	delete(s.files, r.file)
+	r.file = ""
+}
+
+// Reads every batch in the spool, oldest first. Files that can't be read are
+// renamed with a .corrupt suffix and skipped, and leftover temporary files
+// are removed.
+func (s *spool) load() (rs []*retry, err error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json*"))
+	if err != nil {
+		return
+	}
+
+	sort.Strings(names)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			os.Remove(name)
+			continue
+		case !strings.HasSuffix(name, ".json"):
+			continue
+		}
+
+		r, size, e := readSpoolEntry(name)
+		if e != nil {
+			log.Printf("skipping corrupt spooled batch %s: %s\n", name, e)
+			os.Rename(name, name+".corrupt")
+			continue
+		}
+
+		s.files[name] = size
+		s.size += size
+		rs = append(rs, r)
+	}
+
+	return
+}
+
+func readSpoolEntry(name string) (r *retry, size int64, err error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	e := &spoolEntry{}
+	if err = json.Unmarshal(buf, e); err != nil {
+		return
+	}
+
+	var body payload
+	switch e.Path {
+	case "/v1/metrics":
+		body = &Measurement{}
+	case "/v1/measurements":
+		body = &TaggedMeasurement{}
+	default:
+		err = fmt.Errorf("unknown path %q", e.Path)
+		return
+	}
+
+	if err = json.Unmarshal(e.Body, body); err != nil {
+		return
+	}
+
+	if body.Count() == 0 {
+		err = fmt.Errorf("no measurements")
+		return
+	}
+
+	r = &retry{path: e.Path, body: body, created: time.Unix(e.Created, 0), file: name}
+	size = int64(len(buf))
+	return
+}
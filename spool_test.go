@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpoolWriteAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	created := time.Unix(1400000000, 0)
+
+	s, err := newSpool(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &retry{path: "/v1/metrics", body: &Measurement{Counters: []*Counter{{Name: "a", Value: 1}}, MeasureTime: 1400000000}, created: created}
+	b := &retry{path: "/v1/measurements", body: &TaggedMeasurement{Time: 1400000060, Measurements: []interface{}{&TaggedGauge{Name: "b", Value: 2}}}, created: created.Add(time.Minute)}
+	c := &retry{path: "/v1/metrics", body: &Measurement{Counters: []*Counter{{Name: "c", Value: 3}}}, created: created.Add(2 * time.Minute)}
+
+	for _, r := range []*retry{a, b, c} {
+		if err := s.write(r); err != nil {
+			t.Fatal(err)
+		}
+		if r.file == "" {
+			t.Errorf("expected %+v to be given a file", r)
+		}
+	}
+
+	s.remove(c)
+
+	if _, err := os.Stat(c.file); c.file != "" || !os.IsNotExist(err) {
+		t.Errorf("expected removed batch to be deleted")
+	}
+
+	s, _ = newSpool(dir, 1024*1024)
+	rs, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs) != 2 {
+		t.Fatalf("got %d batches, expected 2", len(rs))
+	}
+
+	if rs[0].path != "/v1/metrics" || !rs[0].created.Equal(created) || rs[0].file != a.file {
+		t.Errorf("unexpected first batch: %+v", rs[0])
+	}
+
+	if !reflect.DeepEqual(rs[0].body, a.body) {
+		t.Errorf("got %+v, expected %+v", rs[0].body, a.body)
+	}
+
+	m, ok := rs[1].body.(*TaggedMeasurement)
+	if !ok || m.Time != 1400000060 || m.Count() != 1 {
+		t.Errorf("unexpected second batch: %+v", rs[1].body)
+	}
+
+	if s.size == 0 || len(s.files) != 2 {
+		t.Errorf("got %d bytes in %d files, expected 2 files", s.size, len(s.files))
+	}
+}
+
+func TestSpoolLoadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	ioutil.WriteFile(filepath.Join(dir, "1-1.json"), []byte(`{"path": "/v1/metrics", "body": {"counters": [`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "2-2.json"), []byte(`{"path": "/v1/unknown", "body": {}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "3-3.json"), []byte(`{"path": "/v1/metrics", "body": {"counters": []}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "4-4.json.tmp"), []byte(`{"path": "/v1/me`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "5-5.json"), []byte(`{"path": "/v1/metrics", "created": 1, "body": {"counters": [{"name": "a", "value": 1}]}}`), 0644)
+
+	s, _ := newSpool(dir, 1024*1024)
+	rs, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs) != 1 || rs[0].body.Count() != 1 {
+		t.Fatalf("got %d batches, expected only the valid batch", len(rs))
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	expect := []string{"1-1.json.corrupt", "2-2.json.corrupt", "3-3.json.corrupt", "5-5.json"}
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("got files %+v, expected %+v", names, expect)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	s, _ := newSpool(t.TempDir(), 150)
+
+	a := &retry{path: "/v1/metrics", body: &Measurement{Counters: []*Counter{{Name: "a"}}}, created: time.Now()}
+	b := &retry{path: "/v1/metrics", body: &Measurement{Counters: []*Counter{{Name: "b"}}}, created: time.Now()}
+
+	if err := s.write(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.write(b); err == nil || b.file != "" {
+		t.Errorf("expected the spool to be full")
+	}
+
+	s.remove(a)
+
+	if err := s.write(b); err != nil {
+		t.Errorf("got %s, expected space after removing a batch", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"math"
+	"time"
+)
+
+// A submission to the tagged /v1/measurements api. Tags on the submission
+// apply to every measurement that doesn't override them.
+type TaggedMeasurement struct {
+	Time         int64             `json:"time,omitempty"`
+	Period       int64             `json:"period,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Measurements []interface{}     `json:"measurements"`
+}
+
+func (m *TaggedMeasurement) Count() int {
+	return len(m.Measurements)
+}
+
+// Splits the measurement into batches of at most size measurements, each
+// with the same time, period and tags. A size of zero or less disables
+// splitting.
+func (m *TaggedMeasurement) Split(size int) (ms []*TaggedMeasurement) {
+	if m.Count() == 0 {
+		return
+	}
+
+	if size <= 0 || m.Count() <= size {
+		return []*TaggedMeasurement{m}
+	}
+
+	for i := 0; i < m.Count(); i += size {
+		b := *m
+		b.Measurements = m.Measurements[i:min(i+size, m.Count())]
+		ms = append(ms, &b)
+	}
+
+	return
+}
+
+type TaggedGauge struct {
+	Name  string            `json:"name"`
+	Value float64           `json:"value"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+type TaggedSummary struct {
+	Name   string            `json:"name"`
+	Count  int               `json:"count"`
+	Sum    float64           `json:"sum"`
+	Min    float64           `json:"min"`
+	Max    float64           `json:"max"`
+	Stddev float64           `json:"stddev"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+func buildTaggedMeasurement(s *snapshot) (m *TaggedMeasurement) {
+	m = &TaggedMeasurement{}
+	m.Time = time.Now().Unix()
+	m.Period = *interval
+	m.Measurements = make([]interface{}, 0, len(s.counters)+len(s.gauges)+len(s.sets))
+
+	ts := parseTags(*libratoTags)
+	if libratoSource != nil && *libratoSource != "" {
+		ts = append(ts, "source:"+*libratoSource)
+	}
+	m.Tags = libratoTagMap(ts)
+
+	// Tags on a measurement replace the tags of the submission rather than
+	// adding to them, so the defaults are merged into the measurement's own.
+	// The api rejects a measurement without any tag, along with the rest of
+	// its submission, so those are skipped.
+	untagged := 0
+	add := func(tags *map[string]string, v interface{}) {
+		if *tags = mergeTags(*tags, m.Tags); len(*tags) == 0 && len(m.Tags) == 0 {
+			untagged++
+			return
+		}
+		m.Measurements = append(m.Measurements, v)
+	}
+
+	for k, v := range s.counters {
+		g := buildTaggedGauge(k, v)
+		add(&g.Tags, g)
+	}
+
+	for k, v := range s.gauges {
+		g := buildTaggedGauge(k, v)
+		add(&g.Tags, g)
+	}
+
+	for k, ms := range s.sets {
+		g := buildTaggedGauge(k, float64(len(ms)))
+		add(&g.Tags, g)
+	}
+
+	for k, t := range s.timers {
+		for _, pct := range tilesFor(k) {
+			if c := buildComplexGauge(k, t, pct); c != nil {
+				g := buildTaggedSummary(c)
+				add(&g.Tags, g)
+			}
+		}
+	}
+
+	if untagged > 0 {
+		countInternal("librato.untagged", float64(untagged))
+		if *debug {
+			log.Printf("skipped %d measurements without any tag, specify -tags or -source\n", untagged)
+		}
+	}
+
+	return
+}
+
+// Merges default tags into the tags of a measurement, which take precedence.
+// Without tags of its own, a measurement is left to the defaults of its
+// submission.
+// {"role": "web"}, {"env": "prod", "role": "db"} => {"env": "prod", "role": "web"}
+func mergeTags(tags map[string]string, defaults map[string]string) map[string]string {
+	if len(tags) == 0 || len(defaults) == 0 {
+		return tags
+	}
+
+	merged := maps.Clone(defaults)
+	maps.Copy(merged, tags)
+
+	return merged
+}
+
+func buildTaggedGauge(k string, v float64) *TaggedGauge {
+	g := &TaggedGauge{Value: v}
+	g.Name, g.Tags = parseTagged(k)
+	return g
+}
+
+// Converts a timer summary to the tagged api, which takes a standard
+// deviation in place of the sum of squares.
+func buildTaggedSummary(c *ComplexGauge) *TaggedSummary {
+	g := &TaggedSummary{
+		Name:  c.Name,
+		Count: c.Count,
+		Sum:   c.Sum,
+		Min:   c.Min,
+		Max:   c.Max,
+		Tags:  c.Tags,
+	}
+
+	mean := c.Sum / float64(c.Count)
+	if v := (c.SumSquares / float64(c.Count)) - (mean * mean); v > 0 {
+		g.Stddev = math.Sqrt(v)
+	}
+
+	if c.Source != "" {
+		if g.Tags == nil {
+			g.Tags = make(map[string]string)
+		}
+		g.Tags["source"] = c.Source
+	}
+
+	return g
+}
+
+// Extracts a key into a name and tags, with any source prefix included as a
+// "source" tag.
+// "my_source,my_key|#env:prod" => "my_key", {"env": "prod", "source": "my_source"}
+func parseTagged(k string) (name string, tags map[string]string) {
+	name, source, tags := parseLibrato(k)
+	if source != "" {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["source"] = source
+	}
+
+	return
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBuildTaggedMeasurement(t *testing.T) {
+	agg := newAggregator(4)
+
+	agg.Add(packet{name: "a", bucket: "c", value: 15, tags: []string{"role:web"}})
+	agg.Add(packet{name: "a", bucket: "c", value: 25, tags: []string{"role:web"}})
+	agg.Add(packet{name: "app01,b", bucket: "g", value: 25.1})
+	agg.Add(packet{name: "c", bucket: "s", member: "1"})
+
+	source, tags := "app02", "env:prod"
+	libratoSource, libratoTags = &source, &tags
+
+	m := buildTaggedMeasurement(agg.Snapshot())
+
+	if m.Count() != 3 {
+		t.Errorf("got %d count, expected 3", m.Count())
+	}
+
+	if !reflect.DeepEqual(m.Tags, map[string]string{"env": "prod", "source": "app02"}) {
+		t.Errorf("unexpected default tags: %+v", m.Tags)
+	}
+
+	expect := []interface{}{
+		&TaggedGauge{Name: "a", Value: 40, Tags: map[string]string{"env": "prod", "role": "web", "source": "app02"}},
+		&TaggedGauge{Name: "b", Value: 25.1, Tags: map[string]string{"env": "prod", "source": "app01"}},
+		&TaggedGauge{Name: "c", Value: 1},
+	}
+
+	if !reflect.DeepEqual(m.Measurements, expect) {
+		t.Errorf("got %+v, expected %+v", m.Measurements, expect)
+	}
+
+	// Without defaults, measurements without tags of their own are skipped.
+	empty := ""
+	libratoSource, libratoTags = nil, &empty
+
+	agg.Add(packet{name: "a", bucket: "c", value: 1, tags: []string{"role:web"}})
+	agg.Add(packet{name: "c", bucket: "s", member: "1"})
+
+	m = buildTaggedMeasurement(agg.Snapshot())
+
+	expect = []interface{}{&TaggedGauge{Name: "a", Value: 1, Tags: map[string]string{"role": "web"}}}
+	if m.Tags != nil || !reflect.DeepEqual(m.Measurements, expect) {
+		t.Errorf("got %+v %+v, expected %+v", m.Tags, m.Measurements, expect)
+	}
+}
+
+func TestBuildTaggedSummary(t *testing.T) {
+	c := buildComplexGauge("app01,name|#env:prod", []float64{10, 20, 30, 40}, 100.0)
+	got := buildTaggedSummary(c)
+	expect := &TaggedSummary{
+		Name:   "name",
+		Count:  4,
+		Sum:    100,
+		Min:    10,
+		Max:    40,
+		Stddev: math.Sqrt(125),
+		Tags:   map[string]string{"env": "prod", "source": "app01"},
+	}
+
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got '%+v', expected '%+v'", got, expect)
+	}
+}
+
+func TestBuildTaggedSummaryOnePoint(t *testing.T) {
+	c := buildComplexGauge("name", []float64{30}, 100.0)
+	got := buildTaggedSummary(c)
+	expect := &TaggedSummary{
+		Name:  "name",
+		Count: 1,
+		Sum:   30,
+		Min:   30,
+		Max:   30,
+	}
+
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got '%+v', expected '%+v'", got, expect)
+	}
+}
+
+func TestTaggedMeasurementSplit(t *testing.T) {
+	m := &TaggedMeasurement{Time: 1, Period: 60, Tags: map[string]string{"env": "prod"}}
+	for i := 0; i < 5; i++ {
+		m.Measurements = append(m.Measurements, &TaggedGauge{Value: float64(i)})
+	}
+
+	ms := m.Split(2)
+	if len(ms) != 3 {
+		t.Fatalf("got %d batches, expected 3", len(ms))
+	}
+
+	for i, n := range []int{2, 2, 1} {
+		if ms[i].Count() != n {
+			t.Errorf("got %d measurements in batch %d, expected %d", ms[i].Count(), i, n)
+		}
+		if ms[i].Time != 1 || ms[i].Period != 60 || ms[i].Tags["env"] != "prod" {
+			t.Errorf("unexpected batch %d: %+v", i, ms[i])
+		}
+	}
+
+	if ms[2].Measurements[0].(*TaggedGauge).Value != 4 {
+		t.Errorf("unexpected measurement in batch 2: %+v", ms[2].Measurements[0])
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+func openUnixgram(path string) (conn *net.UnixConn, err error) {
+	if err = removeStaleSocket("unixgram", path); err != nil {
+		return
+	}
+
+	if conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"}); err != nil {
+		return
+	}
+
+	if err = setupSocket(path); err != nil {
+		conn.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return
+}
+
+func openUnix(path string) (listener *net.UnixListener, err error) {
+	if err = removeStaleSocket("unix", path); err != nil {
+		return
+	}
+
+	if listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"}); err != nil {
+		return
+	}
+
+	if err = setupSocket(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return
+}
+
+func readUnixgram(conn *net.UnixConn) {
+	readDatagrams("unixgram", conn)
+}
+
+// Removes a socket file left behind by a previous run. Anything that isn't a
+// socket, or a socket that is still being listened on, is left alone.
+func removeStaleSocket(network string, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial(network, path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	log.Printf("removing stale socket %s\n", path)
+
+	return os.Remove(path)
+}
+
+// Applies the unixMode permissions and unixOwner ownership to a socket file.
+func setupSocket(path string) error {
+	mode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid socket mode %q, expected octal permissions (eg. \"0660\")", *unixMode)
+	}
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		return err
+	}
+
+	if *unixOwner == "" {
+		return nil
+	}
+
+	uid, gid, err := parseOwner(*unixOwner)
+	if err != nil {
+		return err
+	}
+
+	return os.Lchown(path, uid, gid)
+}
+
+// Parses an owner and group, either of which may be a name, an id or empty
+// to leave it unchanged.
+// "statsd:adm" => 105, 4
+// ":1000"      => -1, 1000
+func parseOwner(s string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	owner, group, _ := strings.Cut(s, ":")
+
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			u, e := user.Lookup(owner)
+			if e != nil {
+				return -1, -1, e
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, e := user.LookupGroup(group)
+			if e != nil {
+				return -1, -1, e
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := removeStaleSocket("unix", filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("got %v, expected a missing socket to be ignored", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("a"), 0644)
+	if err := removeStaleSocket("unix", file); err == nil {
+		t.Errorf("expected an error for a regular file")
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := removeStaleSocket("unix", live); err == nil {
+		t.Errorf("expected an error for a socket in use")
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: stale, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := removeStaleSocket("unixgram", stale); err != nil {
+		t.Errorf("got %v, expected a stale socket to be removed", err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", stale)
+	}
+}
+
+func TestReadUnixgram(t *testing.T) {
+	aggregator.Snapshot()
+
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	conn, err := openUnixgram(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("got %+v (%v), expected a socket with mode 0660", fi, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		readUnixgram(conn)
+		close(done)
+	}()
+
+	client, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("a:1|c\nb:2|g"))
+
+	waitPending(2)
+
+	conn.Close()
+	<-done
+
+	if s := aggregator.Snapshot(); s.Count() != 2 || s.counters["a"] != 1 || s.gauges["b"] != 2 {
+		t.Errorf("got %+v, expected counter a and gauge b", s)
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	mode, owner := *unixMode, *unixOwner
+	defer func() { *unixMode, *unixOwner = mode, owner }()
+	*unixMode, *unixOwner = "0600", ""
+
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	l, err := openUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got %+v (%v), expected a socket with mode 0600", fi, err)
+	}
+
+	if _, err := openUnix(path); err == nil {
+		t.Errorf("expected an error for a socket in use")
+	}
+
+	*unixMode = "rw"
+	if _, err := openUnix(filepath.Join(t.TempDir(), "other.sock")); err == nil {
+		t.Errorf("expected an error for an invalid mode")
+	}
+}
+
+var parseOwnerTests = []struct {
+	in  string
+	uid int
+	gid int
+}{
+	{"", -1, -1},
+	{"1000", 1000, -1},
+	{":1000", -1, 1000},
+	{"0:0", 0, 0},
+	{"root:root", 0, 0},
+}
+
+func TestParseOwner(t *testing.T) {
+	for _, s := range parseOwnerTests {
+		uid, gid, err := parseOwner(s.in)
+		if err != nil || uid != s.uid || gid != s.gid {
+			t.Errorf("%q: got %d, %d (%v), expected %d, %d", s.in, uid, gid, err, s.uid, s.gid)
+		}
+	}
+
+	if _, _, err := parseOwner("no-such-user-here"); err == nil {
+		t.Errorf("expected an error for an unknown user")
+	}
+}